@@ -2,19 +2,26 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/function61/gokit/logger"
 	"github.com/function61/gokit/ossignal"
-	"github.com/function61/gokit/systemdinstaller"
+	"github.com/function61/ruuvinator/pkg/hcicapture"
 	"github.com/function61/ruuvinator/pkg/hciframereceiver"
 	"github.com/function61/ruuvinator/pkg/output/consoleoutput"
+	"github.com/function61/ruuvinator/pkg/output/durableoutput"
+	"github.com/function61/ruuvinator/pkg/output/fanoutput"
+	"github.com/function61/ruuvinator/pkg/output/httpoutput"
+	"github.com/function61/ruuvinator/pkg/output/influxoutput"
+	"github.com/function61/ruuvinator/pkg/output/mqttoutput"
+	"github.com/function61/ruuvinator/pkg/output/prometheusoutput"
 	"github.com/function61/ruuvinator/pkg/output/sqsoutput"
+	"github.com/function61/ruuvinator/pkg/queuetransport"
 	"github.com/function61/ruuvinator/pkg/ruuviframeparser"
 	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"github.com/function61/ruuvinator/pkg/sensorresolver"
 	"github.com/spf13/cobra"
-	"os"
+	"time"
 )
 
 func client() error {
@@ -22,36 +29,281 @@ func client() error {
 	log.Info("starting")
 	defer log.Info("stopped")
 
-	conf, err := readConfig()
+	configPath, err := findConfigFile()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	conf, err := readConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	sensorResolver, err := makeSensorResolver(*conf)
+	if err != nil {
+		return err
+	}
+
+	receiveFrames, err := makeFrameReceiver(*conf)
+	if err != nil {
+		return err
+	}
+
+	var capture *hcicapture.Writer
+	if conf.CaptureConfig != nil {
+		capture, err = hcicapture.New(
+			conf.CaptureConfig.Directory,
+			conf.CaptureConfig.MaxSizeBytes,
+			time.Duration(conf.CaptureConfig.MaxAgeSeconds)*time.Second,
+			conf.CaptureConfig.MaxFiles)
+		if err != nil {
+			return fmt.Errorf("capture_config: %s", err.Error())
+		}
+		defer capture.Close()
+	}
+
+	// outputs are stopped only after the receiver, so they can deliver what it gave them
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	var output ruuvinatortypes.Output
+	output, runningOutputs, err := makeOutputs(ctx, *conf)
+	if err != nil {
+		return err
+	}
 
-	switch conf.Output {
-	case "sqsoutput":
-		output = sqsoutput.New(ctx, *conf.SqsOutputConfig)
-	case "console":
-		output = consoleoutput.New()
-	default:
-		panic(errors.New("unknown output: " + conf.Output))
+	receiverCtx, stopReceiver := context.WithCancel(ctx)
+	defer stopReceiver()
+
+	sensorResolverForReloads := sensorresolver.NewSwappable(sensorResolver)
+
+	reloader := &configReloader{
+		ctx:        ctx,
+		configPath: configPath,
+		current:    *conf,
+		resolver:   sensorResolverForReloads,
+		fanout:     output,
+		running:    runningOutputs,
+		log:        logger.New("config-reloader"),
 	}
 
-	observationsCh := output.GetObservationsChan()
+	reloaderStopped := make(chan interface{})
+	go func() {
+		defer close(reloaderStopped)
+
+		reloader.run(receiverCtx)
+	}()
 
 	go func() {
 		log.Info(fmt.Sprintf("got %s; stopping", ossignal.WaitForInterruptOrTerminate()))
 
 		// stops all subprocesses
-		cancel()
+		stopReceiver()
 	}()
 
-	sensorResolver := NewWhitelistResolver(conf.SensorWhitelist)
+	pipeline := processFrame(sensorResolverForReloads, output.GetObservationsChan(), log)
+
+	frameReceived := pipeline
+
+	if capture != nil {
+		// tee raw frames to capture before parsing
+		frameReceived = func(frame hciframereceiver.Frame) {
+			if err := capture.Write(frame); err != nil {
+				log.Error(fmt.Sprintf("capture: %s", err.Error()))
+			}
+
+			pipeline(frame)
+		}
+	}
+
+	receiveFrames(receiverCtx, frameReceived)
+
+	<-reloaderStopped // so outputs aren't being reconfigured while we close them
+
+	// delivers what's buffered. outputs' ctx gets cancelled only after this
+	output.Close()
 
-	hciframereceiver.Run(ctx, func(frame hciframereceiver.Frame) {
+	return nil
+}
+
+func makeFrameReceiver(conf ruuvinatortypes.Config) (func(context.Context, func(hciframereceiver.Frame)), error) {
+	switch conf.BluetoothReceiver {
+	case "", "hcidump":
+		return hciframereceiver.Run, nil
+	case "socket":
+		return func(ctx context.Context, frameReceived func(hciframereceiver.Frame)) {
+			hciframereceiver.RunSocket(ctx, conf.HciDevice, frameReceived)
+		}, nil
+	default:
+		return nil, errors.New("unknown bluetooth_receiver: " + conf.BluetoothReceiver)
+	}
+}
+
+// each observation is delivered to all configured outputs independently
+func makeOutputs(ctx context.Context, conf ruuvinatortypes.Config) (reconfigurableOutput, []runningOutput, error) {
+	outputConfigs := conf.AllOutputs()
+	if len(outputConfigs) == 0 {
+		return nil, nil, errors.New("no outputs configured")
+	}
+
+	toStart := []outputToStart{}
+	for idx, outputConfig := range outputConfigs {
+		toStart = append(toStart, outputToStart{idx, outputConfig})
+	}
+
+	running, err := startOutputs(ctx, toStart)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return fanoutput.New(ctx, destinationsOf(running)), running, nil
+}
+
+type outputToStart struct {
+	idx    int // in config
+	config ruuvinatortypes.OutputConfig
+}
+
+// starts all or none
+func startOutputs(ctx context.Context, toStart []outputToStart) ([]runningOutput, error) {
+	started := []runningOutput{}
+
+	for _, start := range toStart {
+		output, err := makeOutput(ctx, start.config)
+		if err != nil {
+			// don't leave already started ones running
+			for _, startedOutput := range started {
+				startedOutput.output.Close()
+			}
+
+			return nil, fmt.Errorf("outputs[%d]: %s", start.idx, err.Error())
+		}
+
+		started = append(started, runningOutput{
+			name:   fmt.Sprintf("%s#%d", start.config.Type, start.idx),
+			config: start.config,
+			output: output,
+		})
+	}
+
+	return started, nil
+}
+
+func makeOutput(ctx context.Context, conf ruuvinatortypes.OutputConfig) (ruuvinatortypes.Output, error) {
+	output, err := makeBaseOutput(ctx, conf)
+	if err != nil || conf.DurableQueue == nil {
+		return output, err
+	}
+
+	batchOutput, ok := output.(ruuvinatortypes.BatchOutput)
+	if !ok {
+		output.Close()
+		return nil, fmt.Errorf("output %s doesn't support durable_queue", conf.Type)
+	}
+
+	durable, err := durableoutput.New(ctx, *conf.DurableQueue, batchOutput)
+	if err != nil {
+		output.Close()
+		return nil, err
+	}
+
+	return durable, nil
+}
+
+func makeBaseOutput(ctx context.Context, conf ruuvinatortypes.OutputConfig) (ruuvinatortypes.Output, error) {
+	switch conf.Type {
+	case "sqsoutput":
+		if conf.SqsOutputConfig == nil {
+			return nil, errors.New("output sqsoutput needs sqsoutput_config")
+		}
+
+		transport, err := queuetransport.NewSqs(*conf.SqsOutputConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		return sqsoutput.New(ctx, transport), nil
+	case "queue":
+		if conf.QueueOutputConfig == nil {
+			return nil, errors.New("output queue needs queueoutput_config")
+		}
+
+		transport, err := queuetransport.New(*conf.QueueOutputConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		return sqsoutput.New(ctx, transport), nil
+	case "http":
+		if conf.HttpOutputConfig == nil {
+			return nil, errors.New("output http needs httpoutput_config")
+		}
+
+		return httpoutput.New(ctx, *conf.HttpOutputConfig), nil
+	case "console":
+		return consoleoutput.New(), nil
+	case "prometheus":
+		if conf.PrometheusOutputConfig == nil {
+			return nil, errors.New("output prometheus needs prometheusoutput_config")
+		}
+
+		output, err := prometheusoutput.New(ctx, *conf.PrometheusOutputConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		return output, nil
+	case "mqtt":
+		if conf.MqttOutputConfig == nil {
+			return nil, errors.New("output mqtt needs mqttoutput_config")
+		}
+
+		output, err := mqttoutput.New(ctx, *conf.MqttOutputConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		return output, nil
+	case "influxdb":
+		if conf.InfluxOutputConfig == nil {
+			return nil, errors.New("output influxdb needs influxoutput_config")
+		}
+
+		output, err := influxoutput.New(ctx, *conf.InfluxOutputConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		return output, nil
+	default:
+		return nil, errors.New("unknown output: " + conf.Type)
+	}
+}
+
+func makeSensorResolver(conf ruuvinatortypes.Config) (ruuvinatortypes.SensorResolver, error) {
+	resolver := sensorresolver.NewWhitelist(conf.SensorWhitelist)
+
+	if conf.AutoEnrollment != nil {
+		var err error
+		resolver, err = sensorresolver.NewAutoEnroll(*conf.AutoEnrollment, conf.SensorWhitelist)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.DerivedMeasurements {
+		resolver = sensorresolver.WithDerivedMeasurements(resolver)
+	}
+
+	return resolver, nil
+}
+
+// the frame => observation => resolved observation => output pipeline
+func processFrame(
+	sensorResolver ruuvinatortypes.SensorResolver,
+	observationsCh chan<- ruuvinatortypes.ResolvedSensorObservation,
+	log *logger.Logger,
+) func(hciframereceiver.Frame) {
+	return func(frame hciframereceiver.Frame) {
 		// don't bother logging errors, as there is a lot of non-Ruuvi traffic over the air
 		observation, _ := ruuviframeparser.Parse(frame)
 		if observation == nil {
@@ -64,12 +316,8 @@ func client() error {
 			return
 		}
 
-		if observation != nil {
-			observationsCh <- *resolvedObservation
-		}
-	})
-
-	return nil
+		observationsCh <- *resolvedObservation
+	}
 }
 
 func clientEntry() *cobra.Command {
@@ -78,43 +326,24 @@ func clientEntry() *cobra.Command {
 		Short: "Listen for Ruuvi frames over Bluetooth and send them to configured output",
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := client(); err != nil {
-				panic(err)
-			}
+			exitIfError(client())
 		},
 	}
 
-	cmd.AddCommand(&cobra.Command{
+	loadCredentials := false
+
+	writeSystemdUnitFileCmd := &cobra.Command{
 		Use:   "write-systemd-unit-file",
 		Short: "Install unit file to start Ruubinator Bluetooth listener on startup",
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			systemdHints, err := systemdinstaller.InstallSystemdServiceFile("ruuvinator-client", []string{"client"}, "Ruuvinator client")
-			if err != nil {
-				panic(err)
-			}
-
-			fmt.Println(systemdHints)
+			exitIfError(writeSystemdUnitFile(loadCredentials))
 		},
-	})
-
-	return cmd
-}
-
-func readConfig() (*ruuvinatortypes.Config, error) {
-	file, err := os.Open("config.json")
-	if err != nil {
-		return nil, err
 	}
-	defer file.Close()
 
-	jsonDecoder := json.NewDecoder(file)
-	jsonDecoder.DisallowUnknownFields()
+	writeSystemdUnitFileCmd.Flags().BoolVar(&loadCredentials, "load-credentials", loadCredentials, "Pass \"file:\" secrets of config via LoadCredential=, so they can be readable to root only")
 
-	conf := &ruuvinatortypes.Config{}
-	if err := jsonDecoder.Decode(conf); err != nil {
-		return nil, err
-	}
+	cmd.AddCommand(writeSystemdUnitFileCmd)
 
-	return conf, nil
+	return cmd
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/function61/ruuvinator/pkg/configsecrets"
+	"github.com/function61/ruuvinator/pkg/configvalidation"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	configPathEnv = "RUUVINATOR_CONFIG"
+)
+
+var configPathFlag = "" // "--config"
+
+// --config, then $RUUVINATOR_CONFIG, then first one found from the search path
+func findConfigFile() (string, error) {
+	if configPathFlag != "" {
+		return configPathFlag, nil
+	}
+
+	if configPath := os.Getenv(configPathEnv); configPath != "" {
+		return configPath, nil
+	}
+
+	candidates := []string{}
+	for _, dir := range configSearchPath() {
+		for _, name := range []string{"config.json", "config.yaml", "config.yml"} {
+			candidates = append(candidates, filepath.Join(dir, name))
+		}
+	}
+
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf(
+		"config file not found. use --config or %s, or put it in one of: %s",
+		configPathEnv,
+		strings.Join(candidates, ", "))
+}
+
+// working directory first, as that's where it always used to be
+func configSearchPath() []string {
+	dirs := []string{"."}
+
+	xdgConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	if xdgConfigHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			xdgConfigHome = filepath.Join(home, ".config")
+		}
+	}
+
+	if xdgConfigHome != "" {
+		dirs = append(dirs, filepath.Join(xdgConfigHome, "ruuvinator"))
+	}
+
+	return append(dirs, "/etc/ruuvinator")
+}
+
+// with secret references resolved, and validated
+func readConfig(configPath string) (*ruuvinatortypes.Config, error) {
+	conf, err := decodeConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := configsecrets.Resolve(conf); err != nil {
+		return nil, err
+	}
+
+	if err := configvalidation.Validate(*conf); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// JSON, or YAML if the file is named *.yaml or *.yml
+func decodeConfig(configPath string) (*ruuvinatortypes.Config, error) {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		// YAML is converted to JSON, so JSON field names and strict checking apply as-is
+		content, err = yaml.YAMLToJSON(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", configPath, err.Error())
+		}
+	}
+
+	jsonDecoder := json.NewDecoder(bytes.NewReader(content))
+	jsonDecoder.DisallowUnknownFields()
+
+	conf := &ruuvinatortypes.Config{}
+	if err := jsonDecoder.Decode(conf); err != nil {
+		return nil, fmt.Errorf("%s: %s", configPath, err.Error())
+	}
+
+	return conf, nil
+}
+
+func configEntry() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Client configuration",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "validate",
+		Short: "Check config file for problems, without starting anything",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			configPath, err := findConfigFile()
+			exitIfError(err)
+
+			conf, err := readConfig(configPath)
+			exitIfError(err)
+
+			// catches auto-enrollment registry problems
+			_, err = makeSensorResolver(*conf)
+			exitIfError(err)
+
+			fmt.Printf("%s is valid\n", configPath)
+		},
+	})
+
+	return cmd
+}
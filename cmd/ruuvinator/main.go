@@ -15,11 +15,23 @@ func main() {
 		Version: version,
 	}
 
+	app.PersistentFlags().StringVarP(&configPathFlag, "config", "c", "", "Config file (JSON or YAML). Default: search for config.json / config.yaml")
+
 	app.AddCommand(clientEntry())
 	app.AddCommand(metricsServerEntry())
+	app.AddCommand(replayEntry())
+	app.AddCommand(configEntry())
 
 	if err := app.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 }
+
+// for errors meant for the user (like config problems), so no stack trace
+func exitIfError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
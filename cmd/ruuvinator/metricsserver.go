@@ -1,82 +1,149 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/function61/gokit/envvar"
 	"github.com/function61/gokit/logger"
+	"github.com/function61/ruuvinator/pkg/httpingest"
+	"github.com/function61/ruuvinator/pkg/queuetransport"
+	"github.com/function61/ruuvinator/pkg/ruuvimetrics"
 	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
-	"github.com/function61/ruuvinator/pkg/sqsfacade"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // TODO: backoff
 
-func metricsServer(conf ruuvinatortypes.SqsOutputConfig) error {
+type metricsServerConfig struct {
+	Queue               *ruuvinatortypes.QueueConfig // nil = don't consume a queue
+	IngestToken         string                       // "" = no HTTP ingest endpoint
+	QuarantineDirectory string                       // "" = rejected messages are not written anywhere
+	MetricsOptions      ruuvimetrics.Options
+}
+
+func metricsServer(conf metricsServerConfig) error {
 	log := logger.New("metrics-server")
 
-	temperature, humidity, pressure, battery, accelerationSum := initializeMetrics()
+	metrics := ruuvimetrics.New(prometheus.DefaultRegisterer, conf.MetricsOptions)
+
+	go func() {
+		for now := range time.Tick(10 * time.Second) {
+			metrics.ExpireStale(now)
+		}
+	}()
 
 	http.Handle("/metrics", promhttp.Handler())
 
+	if conf.IngestToken != "" {
+		http.Handle("/ingest", httpingest.New(conf.IngestToken, metrics.Observe))
+	}
+
+	if conf.Queue == nil {
+		return http.ListenAndServe(":80", nil)
+	}
+
 	go func() {
 		log.Error(http.ListenAndServe(":80", nil).Error())
 	}()
 
-	sqsClient := sqsfacade.New(
-		conf.QueueUrl,
-		conf.AwsAccessKeyId,
-		conf.AwsAccessKeySecret)
+	return consumeQueue(conf, metrics, log)
+}
+
+func consumeQueue(conf metricsServerConfig, metrics *ruuvimetrics.Metrics, log *logger.Logger) error {
+	transport, err := queuetransport.New(*conf.Queue)
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+
+	if conf.QuarantineDirectory != "" {
+		if err := os.MkdirAll(conf.QuarantineDirectory, 0755); err != nil {
+			return err
+		}
+	}
+
+	rejectedMessages := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ruuvinator_rejected_messages_total",
+		Help: "Queue messages that could not be processed (moved to dead-letter queue)",
+	})
+	prometheus.MustRegister(rejectedMessages)
+
+	ctx := context.Background()
 
 	for {
-		received, err := sqsClient.Receive()
+		received, err := transport.Receive(ctx)
 		if err != nil {
 			log.Error(err.Error())
 			time.Sleep(1 * time.Second) // prevent hot loop
 			continue
 		}
 
-		for _, item := range received.Messages {
+		processed := []queuetransport.Message{}
+		rejected := []queuetransport.Message{}
+
+		for _, item := range received {
 			observations := []ruuvinatortypes.ResolvedSensorObservation{}
-			if err := json.Unmarshal([]byte(*item.Body), &observations); err != nil {
-				// TODO: do not ack this, but let it error so long that it goes in the DLQ
-				log.Error(fmt.Sprintf("error processing %s", *item.Body))
-				continue
-			}
+			if err := json.Unmarshal([]byte(item.Body), &observations); err != nil {
+				log.Error(fmt.Sprintf("rejecting message %s: %s", item.Id, err.Error()))
 
-			for _, observation := range observations {
-				sensorLabels := prometheus.Labels{
-					"sensor": observation.Observation.SensorAddr,
-					"name":   observation.SensorName,
+				rejected = append(rejected, item)
+
+				rejectedMessages.Inc()
+
+				if conf.QuarantineDirectory != "" {
+					if err := quarantine(conf.QuarantineDirectory, item); err != nil {
+						log.Error(fmt.Sprintf("quarantine: %s", err.Error()))
+					}
 				}
 
-				measurements := observation.Observation.Measurements // shorthand
+				continue
+			}
 
-				temperature.With(sensorLabels).Set(measurements.Temperature)
-				humidity.With(sensorLabels).Set(measurements.Humidity)
-				battery.With(sensorLabels).Set(measurements.Battery)
-				pressure.With(sensorLabels).Set(float64(measurements.Pressure))
-				accelerationSum.With(sensorLabels).Set(float64(measurements.Acceleration.X +
-					measurements.Acceleration.Y +
-					measurements.Acceleration.Z))
+			for _, observation := range observations {
+				metrics.Observe(observation)
 			}
+
+			processed = append(processed, item)
 		}
 
-		if err := sqsClient.AckReceived(received); err != nil {
+		if err := transport.Ack(ctx, processed); err != nil {
 			// TODO: retry?
 			log.Error(err.Error())
 		}
+
+		// ends up in the dead-letter queue (for SQS, if the queue has redrive policy)
+		if err := transport.Reject(ctx, rejected); err != nil {
+			log.Error(fmt.Sprintf("Reject: %s", err.Error()))
+		}
 	}
 }
 
+// writes message body to "<id>.txt" for inspection. same message received again (before it
+// is moved to DLQ) overwrites the same file
+func quarantine(directory string, message queuetransport.Message) error {
+	filename := filepath.Join(directory, unsafeFilenameChars.ReplaceAllString(message.Id, "_")+".txt")
+
+	return ioutil.WriteFile(filename, []byte(message.Body), 0644)
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
 func metricsServerEntry() *cobra.Command {
 	return &cobra.Command{
 		Use:   "metricsserver",
-		Short: "Serves metrics downloaded from SQS messages",
+		Short: "Serves metrics from queue (SQS or Redis) messages and/or HTTP pushes",
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
 			conf, err := getConfigFromEnv()
@@ -91,71 +158,100 @@ func metricsServerEntry() *cobra.Command {
 	}
 }
 
-func getConfigFromEnv() (*ruuvinatortypes.SqsOutputConfig, error) {
-	queueUrl, err := envvar.Get("QUEUE_URL")
-	if err != nil {
-		return nil, err
+// QUEUE_TRANSPORT=sqs (default) needs QUEUE_URL (+ optional SQS_REGION, SQS_ENDPOINT).
+// QUEUE_TRANSPORT=redis needs REDIS_ADDR (+ optional REDIS_PASSWORD, REDIS_STREAM, REDIS_GROUP,
+// REDIS_DEAD_LETTER_STREAM).
+// QUEUE_TRANSPORT=none is for when only HTTP ingest (INGEST_TOKEN) is used.
+// QUARANTINE_DIR (optional) is where rejected messages are written to.
+// STALE_TIMEOUT (optional, like "10m". "0" = never) is when silent sensors are marked down.
+// USE_OBSERVATION_TIMESTAMPS=true exports samples with time of observation
+// MOVEMENT_THRESHOLD (optional, in g) is acceleration change that counts as movement
+// TAG_LABELS (optional, like "building,floor") are sensor tags to add as labels
+func getConfigFromEnv() (*metricsServerConfig, error) {
+	conf := &metricsServerConfig{
+		IngestToken:         os.Getenv("INGEST_TOKEN"),
+		QuarantineDirectory: os.Getenv("QUARANTINE_DIR"),
+		MetricsOptions: ruuvimetrics.Options{
+			StaleTimeout:             ruuvimetrics.DefaultStaleTimeout,
+			UseObservationTimestamps: os.Getenv("USE_OBSERVATION_TIMESTAMPS") == "true",
+		},
 	}
 
-	accessKeyId, err := envvar.Get("AWS_ACCESS_KEY_ID")
-	if err != nil {
-		return nil, err
+	if staleTimeout := os.Getenv("STALE_TIMEOUT"); staleTimeout != "" {
+		duration, err := time.ParseDuration(staleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("STALE_TIMEOUT: %s", err.Error())
+		}
+
+		conf.MetricsOptions.StaleTimeout = duration
 	}
 
-	accessKeySecret, err := envvar.Get("AWS_SECRET_ACCESS_KEY")
-	if err != nil {
-		return nil, err
+	if movementThreshold := os.Getenv("MOVEMENT_THRESHOLD"); movementThreshold != "" {
+		threshold, err := strconv.ParseFloat(movementThreshold, 64)
+		if err != nil {
+			return nil, fmt.Errorf("MOVEMENT_THRESHOLD: %s", err.Error())
+		}
+
+		conf.MetricsOptions.MovementThreshold = threshold
 	}
 
-	return &ruuvinatortypes.SqsOutputConfig{
-		QueueUrl:           queueUrl,
-		AwsAccessKeyId:     accessKeyId,
-		AwsAccessKeySecret: accessKeySecret,
-	}, nil
-}
+	if tagLabels := os.Getenv("TAG_LABELS"); tagLabels != "" {
+		conf.MetricsOptions.TagLabels = strings.Split(tagLabels, ",")
 
-func initializeMetrics() (*prometheus.GaugeVec, *prometheus.GaugeVec, *prometheus.GaugeVec, *prometheus.GaugeVec, *prometheus.GaugeVec) {
-	labels := []string{"sensor", "name"}
+		if err := ruuvimetrics.ValidateTagLabels(conf.MetricsOptions.TagLabels); err != nil {
+			return nil, fmt.Errorf("TAG_LABELS: %s", err.Error())
+		}
+	}
 
-	temperature := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "ruuvi_temperature",
-			Help: "Ruuvi: temperature",
-		},
-		labels)
-	prometheus.MustRegister(temperature)
+	switch os.Getenv("QUEUE_TRANSPORT") {
+	case "", "sqs":
+		sqsConfig, err := getSqsConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
 
-	humidity := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "ruuvi_humidity",
-			Help: "Ruuvi: humidity",
-		},
-		labels)
-	prometheus.MustRegister(humidity)
+		conf.Queue = &ruuvinatortypes.QueueConfig{
+			Transport: "sqs",
+			Sqs:       sqsConfig,
+		}
+	case "redis":
+		addr, err := envvar.Get("REDIS_ADDR")
+		if err != nil {
+			return nil, err
+		}
 
-	pressure := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "ruuvi_pressure",
-			Help: "Ruuvi: pressure",
-		},
-		labels)
-	prometheus.MustRegister(pressure)
+		conf.Queue = &ruuvinatortypes.QueueConfig{
+			Transport: "redis",
+			Redis: &ruuvinatortypes.RedisQueueConfig{
+				Addr:             addr,
+				Password:         os.Getenv("REDIS_PASSWORD"),
+				Stream:           os.Getenv("REDIS_STREAM"),
+				Group:            os.Getenv("REDIS_GROUP"),
+				DeadLetterStream: os.Getenv("REDIS_DEAD_LETTER_STREAM"),
+			},
+		}
+	case "none":
+		if conf.IngestToken == "" {
+			return nil, errors.New("QUEUE_TRANSPORT=none needs INGEST_TOKEN")
+		}
+	default:
+		return nil, errors.New("unknown QUEUE_TRANSPORT: " + os.Getenv("QUEUE_TRANSPORT"))
+	}
 
-	battery := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "ruuvi_battery",
-			Help: "Ruuvi: battery",
-		},
-		labels)
-	prometheus.MustRegister(battery)
+	return conf, nil
+}
 
-	accelerationSum := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "ruuvi_acceleration_sum",
-			Help: "Ruuvi: acceleration x + y + z",
-		},
-		labels)
-	prometheus.MustRegister(accelerationSum)
+// AWS credentials (AWS_ACCESS_KEY_ID & AWS_SECRET_ACCESS_KEY, AWS_PROFILE, instance role
+// etc.) and AWS_REGION are picked up by the AWS SDK itself
+func getSqsConfigFromEnv() (*ruuvinatortypes.SqsOutputConfig, error) {
+	queueUrl, err := envvar.Get("QUEUE_URL")
+	if err != nil {
+		return nil, err
+	}
 
-	return temperature, humidity, pressure, battery, accelerationSum
+	return &ruuvinatortypes.SqsOutputConfig{
+		QueueUrl: queueUrl,
+		Region:   os.Getenv("SQS_REGION"),
+		Endpoint: os.Getenv("SQS_ENDPOINT"),
+	}, nil
 }
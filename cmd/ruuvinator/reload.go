@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/function61/gokit/logger"
+	"github.com/function61/ruuvinator/pkg/output/fanoutput"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"github.com/function61/ruuvinator/pkg/sensorresolver"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+const (
+	configChangeCheckInterval = 2 * time.Second
+)
+
+// fanoutput's
+type reconfigurableOutput interface {
+	ruuvinatortypes.Output
+	Add([]fanoutput.Destination)
+	Remove([]ruuvinatortypes.Output)
+}
+
+type runningOutput struct {
+	name   string // for logging
+	config ruuvinatortypes.OutputConfig
+	output ruuvinatortypes.Output
+}
+
+// applies config changes (on SIGHUP or when the file changes) without a restart, so we don't
+// have to restart Bluetooth listening. sensor changes are applied as a whole and only changed
+// outputs are restarted. a config that doesn't load (or whose outputs don't start) is
+// rejected, and the old one kept.
+type configReloader struct {
+	ctx        context.Context // for outputs we start
+	configPath string
+	current    ruuvinatortypes.Config
+	resolver   *sensorresolver.Swappable
+	fanout     reconfigurableOutput
+	running    []runningOutput
+	log        *logger.Logger
+}
+
+// until ctx is cancelled
+func (c *configReloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	checkForChanges := time.NewTicker(configChangeCheckInterval)
+	defer checkForChanges.Stop()
+
+	lastModified := configModTime(c.configPath)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			c.log.Info("got SIGHUP; reloading config")
+
+			lastModified = configModTime(c.configPath)
+
+			c.reload()
+		case <-checkForChanges.C:
+			modified := configModTime(c.configPath)
+			if modified.Equal(lastModified) {
+				continue
+			}
+
+			c.log.Info("config changed; reloading")
+
+			lastModified = modified
+
+			c.reload()
+		}
+	}
+}
+
+func (c *configReloader) reload() {
+	conf, resolver, err := loadReloadableConfig(c.configPath)
+	if err != nil {
+		c.log.Error(fmt.Sprintf("rejected new config, keeping the old one: %s", err.Error()))
+		return
+	}
+
+	if err := c.reconfigureOutputs(conf.AllOutputs()); err != nil {
+		c.log.Error(fmt.Sprintf("rejected new config, keeping the old one: %s", err.Error()))
+		return
+	}
+
+	if conf.BluetoothReceiver != c.current.BluetoothReceiver ||
+		conf.HciDevice != c.current.HciDevice ||
+		!reflect.DeepEqual(conf.CaptureConfig, c.current.CaptureConfig) {
+		c.log.Error("changes to bluetooth_receiver, hci_device or capture_config need a restart")
+	}
+
+	c.resolver.Swap(resolver)
+
+	c.current = *conf
+
+	c.log.Info("config reloaded")
+}
+
+// if a new output doesn't start, the stopped ones are started again with their old config
+func (c *configReloader) reconfigureOutputs(outputConfigs []ruuvinatortypes.OutputConfig) error {
+	running := []runningOutput{}
+	stale := append([]runningOutput{}, c.running...)
+	toStart := []outputToStart{}
+
+	// unchanged ones keep running, so they don't lose their buffers or connections
+	for idx, outputConfig := range outputConfigs {
+		if unchangedIdx := findRunningOutput(stale, outputConfig); unchangedIdx != -1 {
+			running = append(running, stale[unchangedIdx])
+			stale = append(stale[:unchangedIdx], stale[unchangedIdx+1:]...)
+		} else {
+			toStart = append(toStart, outputToStart{idx, outputConfig})
+		}
+	}
+
+	staleOutputs := []ruuvinatortypes.Output{}
+	for _, staleOutput := range stale {
+		staleOutputs = append(staleOutputs, staleOutput.output)
+	}
+
+	// stop first, as new ones might need the same resources (listen_addr, durable_queue)
+	c.fanout.Remove(staleOutputs)
+
+	started, err := startOutputs(c.ctx, toStart)
+	if err != nil {
+		restarted := c.restartOutputs(stale)
+
+		c.fanout.Add(destinationsOf(restarted))
+
+		c.running = append(running, restarted...)
+
+		return err
+	}
+
+	c.fanout.Add(destinationsOf(started))
+
+	c.running = append(running, started...)
+
+	return nil
+}
+
+// best effort. one that doesn't start is logged and left out
+func (c *configReloader) restartOutputs(outputs []runningOutput) []runningOutput {
+	restarted := []runningOutput{}
+
+	for _, previous := range outputs {
+		output, err := makeOutput(c.ctx, previous.config)
+		if err != nil {
+			c.log.Error(fmt.Sprintf("%s: not restarted: %s", previous.name, err.Error()))
+			continue
+		}
+
+		restarted = append(restarted, runningOutput{previous.name, previous.config, output})
+	}
+
+	return restarted
+}
+
+func loadReloadableConfig(configPath string) (*ruuvinatortypes.Config, ruuvinatortypes.SensorResolver, error) {
+	conf, err := readConfig(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resolver, err := makeSensorResolver(*conf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conf, resolver, nil
+}
+
+func destinationsOf(running []runningOutput) []fanoutput.Destination {
+	destinations := []fanoutput.Destination{}
+	for _, runningOutput := range running {
+		destinations = append(destinations, fanoutput.Destination{
+			Name:   runningOutput.name,
+			Output: runningOutput.output,
+		})
+	}
+
+	return destinations
+}
+
+func findRunningOutput(running []runningOutput, config ruuvinatortypes.OutputConfig) int {
+	for idx, candidate := range running {
+		if reflect.DeepEqual(candidate.config, config) {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// zero if it cannot be stat'd
+func configModTime(configPath string) time.Time {
+	stat, err := os.Stat(configPath)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return stat.ModTime()
+}
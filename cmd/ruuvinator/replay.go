@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/function61/gokit/logger"
+	"github.com/function61/gokit/ossignal"
+	"github.com/function61/ruuvinator/pkg/hciframereceiver"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+// feeds a recorded "$ hcidump --raw" capture (or one from client's capture mode) through the
+// same pipeline as the client does. speed=0 means as fast as possible. otherwise original
+// timing is honored (if the capture has timestamps) and speed is the multiplier, e.g.
+// 10 = ten times as fast as recorded.
+func replay(capturePath string, speed float64) error {
+	log := logger.New("replay")
+	log.Info("starting")
+	defer log.Info("stopped")
+
+	configPath, err := findConfigFile()
+	if err != nil {
+		return err
+	}
+
+	conf, err := readConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	sensorResolver, err := makeSensorResolver(*conf)
+	if err != nil {
+		return err
+	}
+
+	capture, err := os.Open(capturePath)
+	if err != nil {
+		return err
+	}
+	defer capture.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	output, _, err := makeOutputs(ctx, *conf)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.Info(fmt.Sprintf("got %s; stopping", ossignal.WaitForInterruptOrTerminate()))
+
+		cancel()
+	}()
+
+	pipeline := processFrame(
+		sensorResolver,
+		output.GetObservationsChan(),
+		log)
+
+	started := time.Now()
+	firstFrameTime := time.Time{}
+	warnedNoTimestamps := false
+	frames := 0
+
+	err = hciframereceiver.ParseCapture(capture, func(frame hciframereceiver.Frame) {
+		select {
+		case <-ctx.Done(): // ParseCapture() cannot be stopped, so just skip the rest
+			return
+		default:
+		}
+
+		if speed > 0 {
+			switch {
+			case frame.Time.IsZero():
+				if !warnedNoTimestamps {
+					log.Error("capture has no timestamps; cannot honor original timing")
+					warnedNoTimestamps = true
+				}
+			case firstFrameTime.IsZero():
+				firstFrameTime = frame.Time
+			default:
+				sinceFirst := time.Duration(float64(frame.Time.Sub(firstFrameTime)) / speed)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Until(started.Add(sinceFirst))):
+				}
+			}
+		}
+
+		frames++
+
+		pipeline(frame)
+	})
+
+	// waits until output has delivered everything we gave it
+	output.Close()
+
+	log.Info(fmt.Sprintf("replayed %d frames in %s", frames, time.Since(started)))
+
+	return err
+}
+
+func replayEntry() *cobra.Command {
+	speed := float64(0)
+
+	cmd := &cobra.Command{
+		Use:   "replay [captureFile]",
+		Short: "Feed a recorded hcidump/client capture through the pipeline to configured output",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			exitIfError(replay(args[0], speed))
+		},
+	}
+
+	cmd.Flags().Float64VarP(&speed, "speed", "s", speed, "Honor original timing (needs timestamps) at this speed multiplier. 0 = as fast as possible")
+
+	return cmd
+}
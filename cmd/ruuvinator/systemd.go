@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/function61/gokit/systemdinstaller"
+	"github.com/function61/ruuvinator/pkg/configsecrets"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	systemdServiceName = "ruuvinator-client"
+	// drop-in, because systemdinstaller doesn't support extra directives
+	credentialsDropInFile = "/etc/systemd/system/" + systemdServiceName + ".service.d/credentials.conf"
+)
+
+func writeSystemdUnitFile(loadCredentials bool) error {
+	clientArgs := []string{"client"}
+
+	// unit's working directory is not obvious, so point to the config explicitly
+	configPath, err := findConfigFile()
+	if err == nil {
+		absConfigPath, err := filepath.Abs(configPath)
+		if err != nil {
+			return err
+		}
+
+		clientArgs = append(clientArgs, "--config", absConfigPath)
+	} else if loadCredentials {
+		return err // need the config to know the files
+	}
+
+	systemdHints, err := systemdinstaller.InstallSystemdServiceFile(systemdServiceName, clientArgs, "Ruuvinator client")
+	if err != nil {
+		return err
+	}
+
+	if loadCredentials {
+		if err := writeCredentialsDropIn(configPath); err != nil {
+			return err
+		}
+
+		fmt.Printf("Wrote %s\n", credentialsDropInFile)
+	}
+
+	fmt.Println(systemdHints)
+
+	return nil
+}
+
+// systemd copies the files to $CREDENTIALS_DIRECTORY, where "file:" secrets are looked up first
+func writeCredentialsDropIn(configPath string) error {
+	conf, err := decodeConfig(configPath) // not resolved, so we see the references
+	if err != nil {
+		return err
+	}
+
+	files := configsecrets.FileRefs(conf)
+	if len(files) == 0 {
+		return errors.New(`no "file:" secrets in config`)
+	}
+
+	lines := []string{"[Service]"}
+	fileByCredentialName := map[string]string{}
+
+	for _, file := range files {
+		if !filepath.IsAbs(file) {
+			return fmt.Errorf("file:%s: LoadCredential= needs an absolute path", file)
+		}
+
+		name := configsecrets.CredentialName(file)
+
+		if otherFile, taken := fileByCredentialName[name]; taken {
+			if otherFile == file { // same secret used in many places
+				continue
+			}
+
+			return fmt.Errorf("%s and %s: credential name %s would be same; rename either", otherFile, file, name)
+		}
+
+		fileByCredentialName[name] = file
+
+		lines = append(lines, fmt.Sprintf("LoadCredential=%s:%s", name, file))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(credentialsDropInFile), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(credentialsDropInFile, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,153 @@
+package configsecrets
+
+import (
+	"fmt"
+	"github.com/function61/ruuvinator/pkg/configvalidation"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	envPrefix  = "env:"
+	filePrefix = "file:"
+)
+
+// secret-bearing config field
+type Field struct {
+	Path  string // "outputs[0].sqsoutput_config.aws_access_key_secret"
+	Value *string
+}
+
+// resolves "env:NAME" and "file:/run/secrets/x" references in secret fields to their values.
+// returns configvalidation.Error, so all problems are reported at once.
+func Resolve(conf *ruuvinatortypes.Config) error {
+	problems := configvalidation.Error{}
+
+	for _, field := range Fields(conf) {
+		value, err := resolveRef(*field.Value)
+		if err != nil {
+			problems = append(problems, configvalidation.Problem{Path: field.Path, Message: err.Error()})
+			continue
+		}
+
+		*field.Value = value
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// files referenced with "file:", in the order they appear in
+func FileRefs(conf *ruuvinatortypes.Config) []string {
+	files := []string{}
+
+	for _, field := range Fields(conf) {
+		if strings.HasPrefix(*field.Value, filePrefix) {
+			files = append(files, strings.TrimPrefix(*field.Value, filePrefix))
+		}
+	}
+
+	return files
+}
+
+// under systemd's LoadCredential= the file is made available in $CREDENTIALS_DIRECTORY under
+// this name. readable to us even if the original is not.
+func CredentialName(file string) string {
+	return filepath.Base(file)
+}
+
+// plain values are returned as-is
+func resolveRef(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, envPrefix):
+		name := strings.TrimPrefix(value, envPrefix)
+
+		envValue, found := os.LookupEnv(name)
+		if !found {
+			return "", fmt.Errorf("env %s not set", name)
+		}
+
+		return envValue, nil
+	case strings.HasPrefix(value, filePrefix):
+		file := strings.TrimPrefix(value, filePrefix)
+
+		if credentialsDirectory := os.Getenv("CREDENTIALS_DIRECTORY"); credentialsDirectory != "" {
+			credential := filepath.Join(credentialsDirectory, CredentialName(file))
+			if _, err := os.Stat(credential); err == nil {
+				file = credential
+			}
+		}
+
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+
+		// editors and "$ echo" leave one
+		return strings.TrimRight(string(content), "\r\n"), nil
+	default:
+		return value, nil
+	}
+}
+
+func Fields(conf *ruuvinatortypes.Config) []Field {
+	fields := []Field{}
+
+	for idx := range conf.Outputs {
+		fields = append(fields, outputFields(fmt.Sprintf("outputs[%d].", idx), &conf.Outputs[idx])...)
+	}
+
+	// the old way. sections are at top level
+	if conf.SqsOutputConfig != nil {
+		fields = append(fields, sqsFields("sqsoutput_config.", conf.SqsOutputConfig)...)
+	}
+
+	return fields
+}
+
+func outputFields(path string, conf *ruuvinatortypes.OutputConfig) []Field {
+	fields := []Field{}
+
+	if conf.SqsOutputConfig != nil {
+		fields = append(fields, sqsFields(path+"sqsoutput_config.", conf.SqsOutputConfig)...)
+	}
+
+	if queue := conf.QueueOutputConfig; queue != nil {
+		if queue.Sqs != nil {
+			fields = append(fields, sqsFields(path+"queueoutput_config.sqs.", queue.Sqs)...)
+		}
+
+		if queue.Redis != nil {
+			fields = append(fields, Field{path + "queueoutput_config.redis.password", &queue.Redis.Password})
+		}
+	}
+
+	if conf.HttpOutputConfig != nil {
+		fields = append(fields, Field{path + "httpoutput_config.token", &conf.HttpOutputConfig.Token})
+	}
+
+	if conf.MqttOutputConfig != nil {
+		fields = append(fields, Field{path + "mqttoutput_config.password", &conf.MqttOutputConfig.Password})
+	}
+
+	if influx := conf.InfluxOutputConfig; influx != nil {
+		fields = append(fields,
+			Field{path + "influxoutput_config.password", &influx.Password},
+			Field{path + "influxoutput_config.token", &influx.Token})
+	}
+
+	return fields
+}
+
+func sqsFields(path string, conf *ruuvinatortypes.SqsOutputConfig) []Field {
+	return []Field{
+		{path + "aws_access_key_id", &conf.AwsAccessKeyId},
+		{path + "aws_access_key_secret", &conf.AwsAccessKeySecret},
+	}
+}
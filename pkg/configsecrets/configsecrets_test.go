@@ -0,0 +1,86 @@
+package configsecrets
+
+import (
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configsecrets")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "aws-secret")
+	assert.True(t, ioutil.WriteFile(secretFile, []byte("E+mEut...\n"), 0600) == nil)
+
+	os.Setenv("TEST_INGEST_TOKEN", "hunter2")
+	defer os.Unsetenv("TEST_INGEST_TOKEN")
+
+	conf := &ruuvinatortypes.Config{
+		Outputs: []ruuvinatortypes.OutputConfig{
+			{
+				Type: "sqsoutput",
+				SqsOutputConfig: &ruuvinatortypes.SqsOutputConfig{
+					AwsAccessKeyId:     "AKIA...",
+					AwsAccessKeySecret: "file:" + secretFile,
+				},
+			},
+			{
+				Type: "http",
+				HttpOutputConfig: &ruuvinatortypes.HttpOutputConfig{
+					Url:   "https://metrics.example.com/ingest",
+					Token: "env:TEST_INGEST_TOKEN",
+				},
+			},
+		},
+	}
+
+	assert.EqualString(t, FileRefs(conf)[0], secretFile)
+
+	assert.True(t, Resolve(conf) == nil)
+
+	assert.EqualString(t, conf.Outputs[0].SqsOutputConfig.AwsAccessKeyId, "AKIA...")
+	assert.EqualString(t, conf.Outputs[0].SqsOutputConfig.AwsAccessKeySecret, "E+mEut...")
+	assert.EqualString(t, conf.Outputs[1].HttpOutputConfig.Token, "hunter2")
+	assert.EqualString(t, conf.Outputs[1].HttpOutputConfig.Url, "https://metrics.example.com/ingest")
+}
+
+func TestResolveProblems(t *testing.T) {
+	conf := &ruuvinatortypes.Config{
+		Output: "mqtt",
+		SqsOutputConfig: &ruuvinatortypes.SqsOutputConfig{
+			AwsAccessKeySecret: "env:TEST_NOT_SET",
+		},
+		Outputs: []ruuvinatortypes.OutputConfig{
+			{
+				Type: "mqtt",
+				MqttOutputConfig: &ruuvinatortypes.MqttOutputConfig{
+					Password: "file:/nonexistent/mqtt-password",
+				},
+			},
+		},
+	}
+
+	assert.EqualString(t, Resolve(conf).Error(), `outputs[0].mqttoutput_config.password: open /nonexistent/mqtt-password: no such file or directory
+sqsoutput_config.aws_access_key_secret: env TEST_NOT_SET not set`)
+}
+
+func TestCredentialsDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configsecrets")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	// as set up by systemd's LoadCredential=influx-password:/etc/ruuvinator/influx-password
+	assert.True(t, ioutil.WriteFile(filepath.Join(dir, "influx-password"), []byte("hunter2"), 0600) == nil)
+
+	os.Setenv("CREDENTIALS_DIRECTORY", dir)
+	defer os.Unsetenv("CREDENTIALS_DIRECTORY")
+
+	password, err := resolveRef("file:/etc/ruuvinator/influx-password")
+	assert.True(t, err == nil)
+	assert.EqualString(t, password, "hunter2")
+}
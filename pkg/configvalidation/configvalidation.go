@@ -0,0 +1,258 @@
+package configvalidation
+
+import (
+	"fmt"
+	"github.com/function61/ruuvinator/pkg/ruuvimetrics"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// lowercase, like we get them from Bluetooth
+var bluetoothAddressRe = regexp.MustCompile("^[0-9a-f]{2}(:[0-9a-f]{2}){5}$")
+
+type Problem struct {
+	Path    string // "outputs[1].sqsoutput_config.queue_url"
+	Message string
+}
+
+// all problems at once, so you don't have to fix them one at a time
+type Error []Problem
+
+func (e Error) Error() string {
+	lines := []string{}
+	for _, problem := range e {
+		lines = append(lines, problem.Path+": "+problem.Message)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+type validator struct {
+	problems Error
+}
+
+func (v *validator) problem(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{path, fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) required(path string, value string) {
+	if value == "" {
+		v.problem(path, "required")
+	}
+}
+
+// returns nil or Error
+func Validate(conf ruuvinatortypes.Config) error {
+	v := &validator{}
+
+	switch conf.BluetoothReceiver {
+	case "", "hcidump", "socket":
+	default:
+		v.problem("bluetooth_receiver", "unknown receiver %q (hcidump | socket)", conf.BluetoothReceiver)
+	}
+
+	if conf.HciDevice < 0 {
+		v.problem("hci_device", "must be >= 0")
+	}
+
+	v.sensorWhitelist(conf.SensorWhitelist)
+
+	if conf.AutoEnrollment != nil {
+		v.required("auto_enrollment.registry_file", conf.AutoEnrollment.RegistryFile)
+	}
+
+	if conf.CaptureConfig != nil {
+		v.required("capture_config.directory", conf.CaptureConfig.Directory)
+
+		if conf.CaptureConfig.MaxFiles < 0 {
+			v.problem("capture_config.max_files", "must be >= 0")
+		}
+	}
+
+	if len(conf.Outputs) == 0 && conf.Output == "" {
+		v.problem("outputs", "no outputs configured")
+	}
+
+	for idx, outputConfig := range conf.Outputs {
+		v.output(fmt.Sprintf("outputs[%d].", idx), "type", outputConfig)
+	}
+
+	if conf.Output != "" { // the old way. sections are at top level
+		v.output("", "output", conf.AllOutputs()[len(conf.Outputs)])
+	}
+
+	if len(v.problems) > 0 {
+		return v.problems
+	}
+
+	return nil
+}
+
+func (v *validator) sensorWhitelist(whitelist ruuvinatortypes.SensorWhitelist) {
+	// sorted, so problems are reported in stable order
+	addrs := []string{}
+	for addr := range whitelist {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	addrByName := map[string]string{}
+
+	for _, addr := range addrs {
+		sensor := whitelist[addr]
+		path := fmt.Sprintf("sensor_whitelist[%q]", addr)
+
+		if !bluetoothAddressRe.MatchString(addr) {
+			v.problem(path, "not a Bluetooth address (like \"aa:bb:cc:dd:ee:ff\", lowercase)")
+		}
+
+		if sensor.Name == "" {
+			v.problem(path+".name", "required")
+		} else if otherAddr, duplicate := addrByName[sensor.Name]; duplicate {
+			v.problem(path+".name", "%q already used by %s", sensor.Name, otherAddr)
+		} else {
+			addrByName[sensor.Name] = addr
+		}
+
+		if sensor.Calibration != nil {
+			v.calibration(path+".calibration.temperature", sensor.Calibration.Temperature)
+			v.calibration(path+".calibration.humidity", sensor.Calibration.Humidity)
+			v.calibration(path+".calibration.pressure", sensor.Calibration.Pressure)
+			v.calibration(path+".calibration.battery", sensor.Calibration.Battery)
+		}
+	}
+}
+
+func (v *validator) calibration(path string, calibration *ruuvinatortypes.LinearCalibration) {
+	if calibration != nil && calibration.Gain != nil && *calibration.Gain <= 0 {
+		v.problem(path+".gain", "must be > 0")
+	}
+}
+
+func (v *validator) output(path string, typeField string, conf ruuvinatortypes.OutputConfig) {
+	supportsDurableQueue := true
+
+	switch conf.Type {
+	case "sqsoutput":
+		if conf.SqsOutputConfig == nil {
+			v.problem(path+"sqsoutput_config", "required for output sqsoutput")
+		} else {
+			v.sqs(path+"sqsoutput_config.", *conf.SqsOutputConfig)
+		}
+	case "queue":
+		if conf.QueueOutputConfig == nil {
+			v.problem(path+"queueoutput_config", "required for output queue")
+		} else {
+			v.queue(path+"queueoutput_config.", *conf.QueueOutputConfig)
+		}
+	case "http":
+		if conf.HttpOutputConfig == nil {
+			v.problem(path+"httpoutput_config", "required for output http")
+		} else {
+			v.required(path+"httpoutput_config.url", conf.HttpOutputConfig.Url)
+			v.required(path+"httpoutput_config.token", conf.HttpOutputConfig.Token)
+		}
+	case "console":
+		supportsDurableQueue = false
+	case "prometheus":
+		supportsDurableQueue = false
+
+		if conf.PrometheusOutputConfig == nil {
+			v.problem(path+"prometheusoutput_config", "required for output prometheus")
+		} else {
+			v.required(path+"prometheusoutput_config.listen_addr", conf.PrometheusOutputConfig.ListenAddr)
+
+			if err := ruuvimetrics.ValidateTagLabels(conf.PrometheusOutputConfig.TagLabels); err != nil {
+				v.problem(path+"prometheusoutput_config.tag_labels", err.Error())
+			}
+		}
+	case "mqtt":
+		if conf.MqttOutputConfig == nil {
+			v.problem(path+"mqttoutput_config", "required for output mqtt")
+		} else {
+			v.mqtt(path+"mqttoutput_config.", *conf.MqttOutputConfig)
+		}
+	case "influxdb":
+		if conf.InfluxOutputConfig == nil {
+			v.problem(path+"influxoutput_config", "required for output influxdb")
+		} else {
+			v.required(path+"influxoutput_config.url", conf.InfluxOutputConfig.Url)
+			v.required(path+"influxoutput_config.database", conf.InfluxOutputConfig.Database)
+
+			if conf.InfluxOutputConfig.Password != "" && conf.InfluxOutputConfig.Username == "" {
+				v.problem(path+"influxoutput_config.username", "required with password")
+			}
+
+			// one on-disk buffer per output is enough
+			if conf.InfluxOutputConfig.SpoolDirectory != "" && conf.DurableQueue != nil {
+				v.problem(path+"influxoutput_config.spool_directory", "can't be used with durable_queue")
+			}
+		}
+	default:
+		v.problem(path+typeField, "unknown output %q", conf.Type)
+		return
+	}
+
+	if conf.DurableQueue != nil {
+		if !supportsDurableQueue {
+			v.problem(path+"durable_queue", "not supported by output %s", conf.Type)
+		} else {
+			v.required(path+"durable_queue.directory", conf.DurableQueue.Directory)
+		}
+	}
+}
+
+func (v *validator) sqs(path string, conf ruuvinatortypes.SqsOutputConfig) {
+	v.required(path+"queue_url", conf.QueueUrl)
+
+	// either both or none (= AWS credential chain)
+	if conf.AwsAccessKeyId != "" && conf.AwsAccessKeySecret == "" {
+		v.problem(path+"aws_access_key_secret", "required with aws_access_key_id")
+	}
+
+	if conf.AwsAccessKeySecret != "" && conf.AwsAccessKeyId == "" {
+		v.problem(path+"aws_access_key_id", "required with aws_access_key_secret")
+	}
+}
+
+func (v *validator) queue(path string, conf ruuvinatortypes.QueueConfig) {
+	switch conf.Transport {
+	case "", "sqs":
+		if conf.Sqs == nil {
+			v.problem(path+"sqs", "required for transport sqs")
+		} else {
+			v.sqs(path+"sqs.", *conf.Sqs)
+		}
+	case "redis":
+		if conf.Redis == nil {
+			v.problem(path+"redis", "required for transport redis")
+		} else {
+			v.required(path+"redis.addr", conf.Redis.Addr)
+		}
+	default:
+		v.problem(path+"transport", "unknown transport %q (sqs | redis)", conf.Transport)
+	}
+}
+
+func (v *validator) mqtt(path string, conf ruuvinatortypes.MqttOutputConfig) {
+	v.required(path+"broker_url", conf.BrokerUrl)
+
+	if conf.Qos > 2 {
+		v.problem(path+"qos", "must be 0, 1 or 2")
+	}
+
+	if conf.Password != "" && conf.Username == "" {
+		v.problem(path+"username", "required with password")
+	}
+
+	// client certificate needs both
+	if conf.TlsCertFile != "" && conf.TlsKeyFile == "" {
+		v.problem(path+"tls_key_file", "required with tls_cert_file")
+	}
+
+	if conf.TlsKeyFile != "" && conf.TlsCertFile == "" {
+		v.problem(path+"tls_cert_file", "required with tls_key_file")
+	}
+}
@@ -0,0 +1,59 @@
+package configvalidation
+
+import (
+	"encoding/json"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	conf := ruuvinatortypes.Config{}
+
+	assert.True(t, json.Unmarshal([]byte(`{
+		"sensor_whitelist": {
+			"aa:bb:cc:dd:ee:ff": "Bedroom",
+			"AA:BB:CC:DD:EE:00": "Bedroom",
+			"ff:ee:dd:cc:bb:aa": {
+				"name": "Greenhouse",
+				"calibration": {"humidity": {"gain": 0}}
+			}
+		},
+		"outputs": [
+			{"type": "sqsoutput"},
+			{"type": "queue", "queueoutput_config": {"transport": "redis", "redis": {}}},
+			{"type": "console", "durable_queue": {"directory": "/tmp"}},
+			{"type": "prometheus", "prometheusoutput_config": {"listen_addr": ":9100", "tag_labels": ["name"]}},
+			{"type": "influx"},
+			{
+				"type": "influxdb",
+				"influxoutput_config": {"url": "http://localhost:8086", "database": "ruuvi", "spool_directory": "/var/lib/ruuvinator/influx-spool"},
+				"durable_queue": {"directory": "/var/lib/ruuvinator/influx-queue"}
+			}
+		],
+		"output": "sqsoutput",
+		"sqsoutput_config": {"queue_url": "https://sqs.example.com/Ruuvinator", "aws_access_key_id": "AKIA..."}
+	}`), &conf) == nil)
+
+	assert.EqualString(t, Validate(conf).Error(), `sensor_whitelist["AA:BB:CC:DD:EE:00"]: not a Bluetooth address (like "aa:bb:cc:dd:ee:ff", lowercase)
+sensor_whitelist["aa:bb:cc:dd:ee:ff"].name: "Bedroom" already used by AA:BB:CC:DD:EE:00
+sensor_whitelist["ff:ee:dd:cc:bb:aa"].calibration.humidity.gain: must be > 0
+outputs[0].sqsoutput_config: required for output sqsoutput
+outputs[1].queueoutput_config.redis.addr: required
+outputs[2].durable_queue: not supported by output console
+outputs[3].prometheusoutput_config.tag_labels: tag label name: reserved
+outputs[4].type: unknown output "influx"
+outputs[5].influxoutput_config.spool_directory: can't be used with durable_queue
+sqsoutput_config.aws_access_key_secret: required with aws_access_key_id`)
+}
+
+func TestValidConfig(t *testing.T) {
+	assert.True(t, Validate(ruuvinatortypes.Config{
+		SensorWhitelist: ruuvinatortypes.SensorWhitelist{
+			"aa:bb:cc:dd:ee:ff": {Name: "Bedroom"},
+		},
+		Output: "console",
+	}) == nil)
+
+	assert.EqualString(t, Validate(ruuvinatortypes.Config{}).Error(), "outputs: no outputs configured")
+}
@@ -0,0 +1,441 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/function61/gokit/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var log = logger.New("diskqueue")
+
+const (
+	cursorFilename         = "cursor"
+	defaultSegmentMaxBytes = 1024 * 1024
+)
+
+// durable FIFO queue of records (records can't contain newlines). records are appended to
+// segment files ("<id>.seg", one record per line) and the read position is stored in a
+// cursor file, so unread records survive process restarts. fully read segments are removed.
+type Queue struct {
+	directory       string
+	maxBytes        int64 // 0 = no limit
+	segmentMaxBytes int64
+	mu              sync.Mutex
+	segments        []uint64 // oldest first. last one is being appended to
+	segmentSizes    map[uint64]int64
+	writer          *os.File
+	readSegment     uint64
+	readOffset      int64
+	appended        chan interface{}
+}
+
+// position of a record. committing an entry marks it (and all before it) as read
+type Entry struct {
+	Data    []byte
+	segment uint64
+	end     int64
+}
+
+// when total size of segments exceeds maxBytes (0 = no limit), oldest segments are dropped,
+// even if they're not read yet
+func Open(directory string, maxBytes int64) (*Queue, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	segmentMaxBytes := int64(defaultSegmentMaxBytes)
+	// so eviction doesn't have to drop too much at once
+	if maxBytes > 0 && maxBytes/4 < segmentMaxBytes {
+		segmentMaxBytes = maxBytes / 4
+	}
+
+	q := &Queue{
+		directory:       directory,
+		maxBytes:        maxBytes,
+		segmentMaxBytes: segmentMaxBytes,
+		segmentSizes:    map[uint64]int64{},
+		appended:        make(chan interface{}, 1),
+	}
+
+	if err := q.scanSegments(); err != nil {
+		return nil, err
+	}
+
+	if len(q.segments) == 0 {
+		q.segments = []uint64{1}
+	}
+
+	if err := q.readCursor(); err != nil {
+		return nil, err
+	}
+
+	lastSegment := q.segments[len(q.segments)-1]
+
+	// previous process could have crashed in the middle of appending
+	if err := q.truncateIncompleteRecord(lastSegment); err != nil {
+		return nil, err
+	}
+
+	writer, err := os.OpenFile(q.segmentPath(lastSegment), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	q.writer = writer
+
+	return q, nil
+}
+
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.writer.Close()
+}
+
+// receives a value when records are appended
+func (q *Queue) Appended() <-chan interface{} {
+	return q.appended
+}
+
+// records are on disk (fsync'd) when this returns
+func (q *Queue) Append(records [][]byte) error {
+	buf := &bytes.Buffer{}
+
+	for _, record := range records {
+		if bytes.IndexByte(record, '\n') != -1 {
+			return errors.New("Append: record cannot contain newline")
+		}
+
+		buf.Write(record)
+		buf.WriteByte('\n')
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.segmentSizes[q.currentSegment()] >= q.segmentMaxBytes {
+		if err := q.startNewSegment(); err != nil {
+			return err
+		}
+	}
+
+	n, err := q.writer.Write(buf.Bytes())
+	q.segmentSizes[q.currentSegment()] += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if err := q.writer.Sync(); err != nil {
+		return err
+	}
+
+	if err := q.evictOldestIfTooBig(); err != nil {
+		return err
+	}
+
+	select {
+	case q.appended <- nil:
+	default: // reader has not yet noticed previous append
+	}
+
+	return nil
+}
+
+// reads up to max oldest unread records. they stay in the queue until committed
+func (q *Queue) Read(max int) ([]Entry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries := []Entry{}
+
+	offset := q.readOffset
+
+	for _, segment := range q.segments {
+		if segment < q.readSegment {
+			continue
+		}
+
+		if segment > q.readSegment {
+			offset = 0
+		}
+
+		segmentEntries, err := q.readSegmentFrom(segment, offset, max-len(entries))
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, segmentEntries...)
+
+		if len(entries) >= max {
+			break
+		}
+	}
+
+	return entries, nil
+}
+
+// marks entry and all entries before it as read
+func (q *Queue) Commit(entry Entry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if entry.segment < q.readSegment || (entry.segment == q.readSegment && entry.end <= q.readOffset) {
+		return nil // already read (or evicted) in the meantime
+	}
+
+	q.readSegment = entry.segment
+	q.readOffset = entry.end
+
+	for len(q.segments) > 1 {
+		oldest := q.segments[0]
+
+		fullyRead := oldest == q.readSegment && q.readOffset >= q.segmentSizes[oldest]
+
+		if oldest >= q.readSegment && !fullyRead {
+			break
+		}
+
+		if fullyRead {
+			q.readSegment = q.segments[1]
+			q.readOffset = 0
+		}
+
+		if err := q.removeOldestSegment(); err != nil {
+			return err
+		}
+	}
+
+	return q.writeCursor()
+}
+
+func (q *Queue) readSegmentFrom(segment uint64, offset int64, max int) ([]Entry, error) {
+	file, err := os.Open(q.segmentPath(segment))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	entries := []Entry{}
+
+	reader := bufio.NewReader(file)
+
+	for len(entries) < max {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF { // incomplete line is not yet a record
+				break
+			}
+
+			return nil, err
+		}
+
+		offset += int64(len(line))
+
+		entries = append(entries, Entry{
+			Data:    line[:len(line)-1],
+			segment: segment,
+			end:     offset,
+		})
+	}
+
+	return entries, nil
+}
+
+func (q *Queue) currentSegment() uint64 {
+	return q.segments[len(q.segments)-1]
+}
+
+func (q *Queue) startNewSegment() error {
+	if err := q.writer.Close(); err != nil {
+		return err
+	}
+
+	segment := q.currentSegment() + 1
+
+	writer, err := os.OpenFile(q.segmentPath(segment), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	q.writer = writer
+	q.segments = append(q.segments, segment)
+	q.segmentSizes[segment] = 0
+
+	return nil
+}
+
+func (q *Queue) evictOldestIfTooBig() error {
+	if q.maxBytes == 0 {
+		return nil
+	}
+
+	total := int64(0)
+	for _, size := range q.segmentSizes {
+		total += size
+	}
+
+	cursorMoved := false
+
+	// never evict the segment being appended to
+	for total > q.maxBytes && len(q.segments) > 1 {
+		oldest := q.segments[0]
+
+		if oldest >= q.readSegment {
+			log.Error(fmt.Sprintf(
+				"%s: max size exceeded; dropping %d bytes of unread records",
+				q.directory,
+				q.segmentSizes[oldest]-q.unreadOffsetIn(oldest)))
+
+			q.readSegment = q.segments[1]
+			q.readOffset = 0
+			cursorMoved = true
+		}
+
+		total -= q.segmentSizes[oldest]
+
+		if err := q.removeOldestSegment(); err != nil {
+			return err
+		}
+	}
+
+	if cursorMoved {
+		return q.writeCursor()
+	}
+
+	return nil
+}
+
+func (q *Queue) unreadOffsetIn(segment uint64) int64 {
+	if segment == q.readSegment {
+		return q.readOffset
+	}
+
+	return 0
+}
+
+func (q *Queue) removeOldestSegment() error {
+	oldest := q.segments[0]
+
+	if err := os.Remove(q.segmentPath(oldest)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	q.segments = q.segments[1:]
+	delete(q.segmentSizes, oldest)
+
+	return nil
+}
+
+func (q *Queue) scanSegments() error {
+	paths, err := filepath.Glob(filepath.Join(q.directory, "*.seg"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		segment, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".seg"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected file in queue directory: %s", path)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		q.segments = append(q.segments, segment)
+		q.segmentSizes[segment] = info.Size()
+	}
+
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	return nil
+}
+
+// cursor file content: "<segment> <offset>"
+func (q *Queue) readCursor() error {
+	q.readSegment = q.segments[0]
+	q.readOffset = 0
+
+	content, err := ioutil.ReadFile(filepath.Join(q.directory, cursorFilename))
+	if err != nil {
+		if os.IsNotExist(err) { // nothing read yet
+			return nil
+		}
+
+		return err
+	}
+
+	var segment uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(content), "%d %d", &segment, &offset); err != nil {
+		return fmt.Errorf("readCursor: %s", err.Error())
+	}
+
+	// segment was evicted or removed => start from oldest remaining
+	if _, exists := q.segmentSizes[segment]; !exists {
+		return nil
+	}
+
+	q.readSegment = segment
+	q.readOffset = offset
+
+	return nil
+}
+
+func (q *Queue) writeCursor() error {
+	cursorPath := filepath.Join(q.directory, cursorFilename)
+
+	// write + rename so a crash doesn't leave a half-written cursor
+	if err := ioutil.WriteFile(
+		cursorPath+".tmp",
+		[]byte(fmt.Sprintf("%d %d\n", q.readSegment, q.readOffset)),
+		0644,
+	); err != nil {
+		return err
+	}
+
+	return os.Rename(cursorPath+".tmp", cursorPath)
+}
+
+func (q *Queue) truncateIncompleteRecord(segment uint64) error {
+	content, err := ioutil.ReadFile(q.segmentPath(segment))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	completeLength := int64(bytes.LastIndexByte(content, '\n') + 1)
+
+	if completeLength == int64(len(content)) {
+		return nil
+	}
+
+	log.Error(fmt.Sprintf("%s: discarding incomplete record", q.segmentPath(segment)))
+
+	q.segmentSizes[segment] = completeLength
+
+	return os.Truncate(q.segmentPath(segment), completeLength)
+}
+
+func (q *Queue) segmentPath(segment uint64) string {
+	return filepath.Join(q.directory, fmt.Sprintf("%020d.seg", segment))
+}
@@ -0,0 +1,151 @@
+package diskqueue
+
+import (
+	"github.com/function61/gokit/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppendReadCommit(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir, 0)
+	assert.True(t, err == nil)
+
+	assert.True(t, q.Append(records("a", "b", "c")) == nil)
+
+	entries, err := q.Read(2)
+	assert.True(t, err == nil)
+	assert.EqualString(t, entriesAsString(entries), "a,b")
+
+	// not committed => same ones again
+	entries, err = q.Read(2)
+	assert.True(t, err == nil)
+	assert.EqualString(t, entriesAsString(entries), "a,b")
+
+	assert.True(t, q.Commit(entries[1]) == nil)
+
+	entries, err = q.Read(10)
+	assert.True(t, err == nil)
+	assert.EqualString(t, entriesAsString(entries), "c")
+}
+
+func TestSurvivesRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir, 0)
+	assert.True(t, err == nil)
+	q.segmentMaxBytes = 4 // force a few segments
+
+	assert.True(t, q.Append(records("1", "2")) == nil)
+	assert.True(t, q.Append(records("3", "4")) == nil)
+	assert.True(t, q.Append(records("5")) == nil)
+
+	entries, err := q.Read(3)
+	assert.True(t, err == nil)
+	assert.True(t, q.Commit(entries[2]) == nil)
+	assert.True(t, q.Close() == nil)
+
+	// fully read segment was removed
+	assert.True(t, len(segmentFiles(t, dir)) == 2)
+
+	q, err = Open(dir, 0)
+	assert.True(t, err == nil)
+
+	entries, err = q.Read(10)
+	assert.True(t, err == nil)
+	assert.EqualString(t, entriesAsString(entries), "4,5")
+
+	assert.True(t, q.Append(records("6")) == nil)
+
+	entries, err = q.Read(10)
+	assert.True(t, err == nil)
+	assert.EqualString(t, entriesAsString(entries), "4,5,6")
+}
+
+func TestIncompleteRecordIsDiscarded(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir, 0)
+	assert.True(t, err == nil)
+	assert.True(t, q.Append(records("complete")) == nil)
+	assert.True(t, q.Close() == nil)
+
+	// simulate crash in the middle of writing
+	segment, err := os.OpenFile(segmentFiles(t, dir)[0], os.O_WRONLY|os.O_APPEND, 0644)
+	assert.True(t, err == nil)
+	_, _ = segment.WriteString("incompl")
+	segment.Close()
+
+	q, err = Open(dir, 0)
+	assert.True(t, err == nil)
+	assert.True(t, q.Append(records("next")) == nil)
+
+	entries, err := q.Read(10)
+	assert.True(t, err == nil)
+	assert.EqualString(t, entriesAsString(entries), "complete,next")
+}
+
+func TestEvictsOldest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir, 16) // => 4 byte segments
+	assert.True(t, err == nil)
+
+	for _, record := range []string{"01", "02", "03", "04", "05", "06", "07", "08", "09", "10"} {
+		assert.True(t, q.Append(records(record)) == nil)
+	}
+
+	entries, err := q.Read(100)
+	assert.True(t, err == nil)
+	assert.EqualString(t, entriesAsString(entries), "07,08,09,10")
+}
+
+func TestRejectsNewline(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir, 0)
+	assert.True(t, err == nil)
+
+	assert.EqualString(t, q.Append(records("foo\nbar")).Error(), "Append: record cannot contain newline")
+}
+
+func records(items ...string) [][]byte {
+	recs := [][]byte{}
+	for _, item := range items {
+		recs = append(recs, []byte(item))
+	}
+
+	return recs
+}
+
+func entriesAsString(entries []Entry) string {
+	items := []string{}
+	for _, entry := range entries {
+		items = append(items, string(entry.Data))
+	}
+
+	return strings.Join(items, ",")
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	assert.True(t, err == nil)
+
+	return files
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	assert.True(t, err == nil)
+
+	return dir
+}
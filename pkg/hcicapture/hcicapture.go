@@ -0,0 +1,152 @@
+package hcicapture
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/function61/ruuvinator/pkg/hciframereceiver"
+	"github.com/function61/ruuvinator/pkg/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	fileHeader = "HCI sniffer - Ruuvinator capture\n" // hciframereceiver skips this line
+)
+
+// writes raw HCI frames into capture files in the same format as "$ hcidump --raw -t" (with
+// Unix timestamps), so they can be read back with hciframereceiver.ParseCapture()
+type Writer struct {
+	directory   string
+	maxSize     int64         // 0 = no limit
+	maxAge      time.Duration // 0 = no limit
+	maxFiles    int           // 0 = no limit
+	current     *os.File
+	currentSize int64
+	currentOpen time.Time
+	now         func() time.Time // for tests
+}
+
+// writes to files named "capture-<timestamp>.txt" in directory. new file is started when
+// current one grows larger than maxSize or older than maxAge, and then only the newest
+// maxFiles are kept (0 = no limit)
+func New(directory string, maxSize int64, maxAge time.Duration, maxFiles int) (*Writer, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		directory: directory,
+		maxSize:   maxSize,
+		maxAge:    maxAge,
+		maxFiles:  maxFiles,
+		now:       time.Now,
+	}, nil
+}
+
+// not safe for concurrent use
+func (w *Writer) Write(frame hciframereceiver.Frame) error {
+	if err := w.rotateIfNeeded(); err != nil {
+		return err
+	}
+
+	received := frame.Time
+	if received.IsZero() {
+		received = w.now()
+	}
+
+	n, err := w.current.WriteString(formatLine(frame, received))
+	w.currentSize += int64(n)
+
+	return err
+}
+
+func (w *Writer) Close() error {
+	if w.current == nil {
+		return nil
+	}
+
+	err := w.current.Close()
+	w.current = nil
+
+	return err
+}
+
+func (w *Writer) rotateIfNeeded() error {
+	if w.current != nil {
+		tooBig := w.maxSize > 0 && w.currentSize >= w.maxSize
+		tooOld := w.maxAge > 0 && w.now().Sub(w.currentOpen) >= w.maxAge
+
+		if !tooBig && !tooOld {
+			return nil
+		}
+
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+
+	w.currentOpen = w.now()
+
+	filename := filepath.Join(
+		w.directory,
+		fmt.Sprintf("capture-%s.txt", w.currentOpen.UTC().Format("20060102_150405.000000")))
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	n, err := file.WriteString(fileHeader)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.current = file
+	w.currentSize = int64(n)
+
+	return w.deleteOldFiles()
+}
+
+// also ones left over from previous runs
+func (w *Writer) deleteOldFiles() error {
+	if w.maxFiles == 0 {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(w.directory, "capture-*.txt"))
+	if err != nil {
+		return err
+	}
+
+	// timestamp in filename makes these sort oldest first
+	sort.Strings(files)
+
+	for len(files) > w.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+
+		files = files[1:]
+	}
+
+	return nil
+}
+
+// "1552832537.123456 > 04 3E 21 ..." (whole frame on one line)
+func formatLine(frame hciframereceiver.Frame, received time.Time) string {
+	direction := ">"
+	if frame.Direction == hciframereceiver.HciDumpDirectionOutbound {
+		direction = "<"
+	}
+
+	return fmt.Sprintf(
+		"%d.%06d %s %s\n",
+		received.Unix(),
+		received.Nanosecond()/int(time.Microsecond),
+		direction,
+		strings.ToUpper(utils.SplitStringIntoGroupsOfTwo(hex.EncodeToString(frame.Data), " ")))
+}
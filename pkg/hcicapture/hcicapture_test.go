@@ -0,0 +1,128 @@
+package hcicapture
+
+import (
+	"bytes"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/hciframereceiver"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortestdata"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteAndReadBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcicapture")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	recorded := []hciframereceiver.Frame{}
+	assert.True(t, hciframereceiver.ParseStream(strings.NewReader(ruuvinatortestdata.DemoStream), func(frame hciframereceiver.Frame) {
+		recorded = append(recorded, frame)
+	}) == nil)
+
+	// rotates roughly after every third frame
+	writer, err := New(dir, 300, 0, 0)
+	assert.True(t, err == nil)
+
+	clock := time.Date(2019, 3, 17, 14, 22, 17, 123456000, time.UTC)
+	writer.now = func() time.Time {
+		clock = clock.Add(time.Millisecond) // unique filenames
+		return clock
+	}
+
+	for i, frame := range recorded {
+		frame.Time = time.Unix(1552832537+int64(i), 1000)
+
+		assert.True(t, writer.Write(frame) == nil)
+	}
+	assert.True(t, writer.Close() == nil)
+
+	// filenames are ordered by time
+	files, err := filepath.Glob(filepath.Join(dir, "capture-*.txt"))
+	assert.True(t, err == nil)
+	assert.True(t, len(files) > 3)
+
+	readBack := []hciframereceiver.Frame{}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		assert.True(t, err == nil)
+
+		assert.True(t, hciframereceiver.ParseCapture(bytes.NewReader(content), func(frame hciframereceiver.Frame) {
+			readBack = append(readBack, frame)
+		}) == nil)
+	}
+
+	assert.True(t, len(readBack) == len(recorded))
+
+	for i, frame := range readBack {
+		assert.True(t, frame.Direction == recorded[i].Direction)
+		assert.True(t, bytes.Equal(frame.Data, recorded[i].Data))
+		assert.True(t, frame.Time.Equal(time.Unix(1552832537+int64(i), 1000)))
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcicapture")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	writer, err := New(dir, 0, time.Hour, 0)
+	assert.True(t, err == nil)
+
+	clock := time.Date(2019, 3, 17, 14, 0, 0, 0, time.UTC)
+	writer.now = func() time.Time { return clock }
+
+	frame := hciframereceiver.Frame{Data: []byte{0x04, 0x0e, 0x04, 0x01, 0x0c, 0x20, 0x00}}
+
+	assert.True(t, writer.Write(frame) == nil)
+	clock = clock.Add(59 * time.Minute)
+	assert.True(t, writer.Write(frame) == nil)
+	clock = clock.Add(time.Minute)
+	assert.True(t, writer.Write(frame) == nil)
+	assert.True(t, writer.Close() == nil)
+
+	files, err := filepath.Glob(filepath.Join(dir, "capture-*.txt"))
+	assert.True(t, err == nil)
+	assert.True(t, len(files) == 2)
+	assert.EqualString(t, filepath.Base(files[0]), "capture-20190317_140000.000000.txt")
+
+	content, err := ioutil.ReadFile(files[0])
+	assert.True(t, err == nil)
+	assert.EqualString(t, string(content), `HCI sniffer - Ruuvinator capture
+1552831200.000000 > 04 0E 04 01 0C 20 00
+1552834740.000000 > 04 0E 04 01 0C 20 00
+`)
+}
+
+func TestDeleteOldFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcicapture")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	// left over from a previous run
+	assert.True(t, ioutil.WriteFile(filepath.Join(dir, "capture-20190316_000000.000000.txt"), []byte(fileHeader), 0644) == nil)
+
+	writer, err := New(dir, 0, time.Hour, 2)
+	assert.True(t, err == nil)
+
+	clock := time.Date(2019, 3, 17, 14, 0, 0, 0, time.UTC)
+	writer.now = func() time.Time { return clock }
+
+	frame := hciframereceiver.Frame{Data: []byte{0x04, 0x0e, 0x04, 0x01, 0x0c, 0x20, 0x00}}
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, writer.Write(frame) == nil)
+		clock = clock.Add(time.Hour)
+	}
+	assert.True(t, writer.Close() == nil)
+
+	files, err := filepath.Glob(filepath.Join(dir, "capture-*.txt"))
+	assert.True(t, err == nil)
+	assert.True(t, len(files) == 2)
+	assert.EqualString(t, filepath.Base(files[0]), "capture-20190317_150000.000000.txt")
+	assert.EqualString(t, filepath.Base(files[1]), "capture-20190317_160000.000000.txt")
+}
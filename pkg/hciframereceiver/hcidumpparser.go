@@ -6,7 +6,10 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 /*	There are three kind of lines in hcidump output:
@@ -21,45 +24,80 @@ const (
 	hciDumpPrefixContinuation = "  "
 )
 
+// "$ hcidump --raw -t" prefixes each inbound/outbound line with a timestamp, either in local
+// time ("2019-03-17 14:22:17.123456 ") or Unix time ("1552832537.123456 ")
+var hciDumpTimestampRe = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\.\d{6}|\s*\d+\.\d{6}) `)
+
 func ParseStream(stream io.Reader, frameReceived func(Frame)) error {
+	return parseStream(stream, frameReceived, false)
+}
+
+// like ParseStream(), but for finished captures (like ones from hcicapture) we know that
+// the last frame was written as a whole, so we can emit it as well
+func ParseCapture(stream io.Reader, frameReceived func(Frame)) error {
+	return parseStream(stream, frameReceived, true)
+}
+
+func parseStream(stream io.Reader, frameReceived func(Frame), lastFrameComplete bool) error {
 	lineScanner := bufio.NewScanner(stream)
 	lineScanner.Split(bufio.ScanLines)
 
 	var currentDirection HciDumpDirection = 0
+	currentTime := time.Time{}
 	currentLine := ""
 
 	// since each line doesn't contain hint if the payload is continued in the next line,
 	// only after we see that a new inbound/outbound msg encountered we know that previous
 	// msg was finished as a whole
-	emitPreviousFinishedLine := func() {
+	emitPreviousFinishedLine := func() error {
 		if currentLine == "" {
-			return
+			return nil
 		}
 
 		asBytes, err := hexStringToBytes(currentLine)
 		if err != nil {
-			panic(err)
+			return errors.New("invalid hex for line: " + currentLine)
 		}
 
 		frameReceived(Frame{
 			Direction: currentDirection,
 			Data:      asBytes,
+			Time:      currentTime,
 		})
 
 		currentLine = ""
+
+		return nil
 	}
 
 	for lineScanner.Scan() {
 		line := lineScanner.Text()
 
+		lineTime := time.Time{}
+		if match := hciDumpTimestampRe.FindStringSubmatch(line); match != nil {
+			var err error
+			lineTime, err = parseHciDumpTimestamp(match[1])
+			if err != nil {
+				return err
+			}
+
+			line = line[len(match[0]):]
+		}
+
 		switch {
 		case strings.HasPrefix(line, hciDumpPrefixInbound):
-			emitPreviousFinishedLine()
+			if err := emitPreviousFinishedLine(); err != nil {
+				return err
+			}
 			currentDirection = HciDumpDirectionInbound
+			currentTime = lineTime
 			currentLine = line[len(hciDumpPrefixInbound):]
 		case strings.HasPrefix(line, hciDumpPrefixOutbound):
-			emitPreviousFinishedLine()
+			if err := emitPreviousFinishedLine(); err != nil {
+				return err
+			}
 			currentDirection = HciDumpDirectionOutbound
+			currentTime = lineTime
 			currentLine = line[len(hciDumpPrefixOutbound):]
 		case strings.HasPrefix(line, hciDumpPrefixContinuation):
 			currentLine += " " + line[len(hciDumpPrefixContinuation):]
@@ -74,11 +112,38 @@ func ParseStream(stream io.Reader, frameReceived func(Frame)) error {
 		return err
 	}
 
-	// cannot emit here, since we don't know if the last line would have had continuation
+	// for live streams cannot emit here, since we don't know if the last line would have
+	// had continuation
+	if lastFrameComplete {
+		return emitPreviousFinishedLine()
+	}
 
 	return nil
 }
 
+func parseHciDumpTimestamp(timestamp string) (time.Time, error) {
+	timestamp = strings.TrimLeft(timestamp, " ")
+
+	if strings.Contains(timestamp, "-") { // "2019-03-17 14:22:17.123456"
+		return time.ParseInLocation("2006-01-02 15:04:05.000000", timestamp, time.Local)
+	}
+
+	// "1552832537.123456"
+	secAndUsec := strings.Split(timestamp, ".")
+
+	sec, err := strconv.ParseInt(secAndUsec[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	usec, err := strconv.ParseInt(secAndUsec[1], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(sec, usec*int64(time.Microsecond)), nil
+}
+
 // input example: "FF 00 BA DF 00 D0"
 func hexStringToBytes(hexStringWithSpaces string) ([]byte, error) {
 	hexString := strings.Replace(hexStringWithSpaces, " ", "", -1)
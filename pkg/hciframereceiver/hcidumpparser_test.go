@@ -7,6 +7,7 @@ import (
 	"github.com/function61/ruuvinator/pkg/utils"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestMain(t *testing.T) {
@@ -31,3 +32,36 @@ func TestMain(t *testing.T) {
 	assertOne(frames[0], HciDumpDirectionInbound, "04 3E 1B 02 01 00 00 26 1B C6 08 03 60 0F 02 01 1A 0B FF 4C 00 09 06 03 15 C0 A8 0A 25 A8")
 	assertOne(frames[12], HciDumpDirectionOutbound, "01 0C 20 02 00 00")
 }
+
+func TestParseStreamWithTimestamps(t *testing.T) {
+	frames := []Frame{}
+
+	err := ParseStream(strings.NewReader(ruuvinatortestdata.DemoStreamWithTimestamps), func(frame Frame) {
+		frames = append(frames, frame)
+	})
+
+	assert.True(t, err == nil)
+	assert.True(t, len(frames) == 2) // last one is not emitted, see ParseStream()
+	assert.True(t, frames[0].Direction == HciDumpDirectionInbound)
+	assert.True(t, len(frames[0].Data) == 36)
+	assert.EqualString(t, frames[0].Time.UTC().Format(time.RFC3339Nano), "2019-03-17T14:22:17.123456Z")
+	assert.True(t, frames[1].Time.Sub(frames[0].Time) == 1500*time.Millisecond)
+
+	frames = []Frame{}
+
+	err = ParseStream(strings.NewReader("> 04 0E 04 01 0C 20 00\n> 04 0E 04 01 0C 20 00\n"), func(frame Frame) {
+		frames = append(frames, frame)
+	})
+
+	assert.True(t, err == nil)
+	assert.True(t, len(frames) == 1)
+	assert.True(t, frames[0].Time.IsZero())
+}
+
+func TestParseStreamInvalidHex(t *testing.T) {
+	err := ParseCapture(strings.NewReader("> 04 0E 04 01 0C 20 0G\n"), func(frame Frame) {
+		t.Fatal("should not be called")
+	})
+
+	assert.EqualString(t, err.Error(), "invalid hex for line: 04 0E 04 01 0C 20 0G")
+}
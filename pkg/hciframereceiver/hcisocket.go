@@ -0,0 +1,157 @@
+package hciframereceiver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/function61/gokit/logger"
+	"time"
+)
+
+// native alternative for hcitool + hcidump subprocesses: we talk to the Bluetooth adapter
+// over a raw HCI socket ourselves
+
+const (
+	hciCommandPkt = 0x01
+	hciEventPkt   = 0x04
+
+	opcodeLeSetScanParameters = 0x200b // OGF 0x08 (LE controller), OCF 0x000b
+	opcodeLeSetScanEnable     = 0x200c // OGF 0x08 (LE controller), OCF 0x000c
+
+	// 0x0010 * 0.625 ms = 10 ms. window == interval means we're scanning all the time.
+	// these are the same values "$ hcitool lescan" uses
+	leScanInterval = 0x0010
+	leScanWindow   = 0x0010
+
+	hciMaxFrameSize = 1024 // events are at most 258 bytes, but let's have some slack
+)
+
+// a raw HCI socket (or something pretending to be one, like in tests). each Read() returns
+// exactly one HCI packet with the packet type indicator as the first byte (the same bytes
+// "$ hcidump --raw" displays), and each Write() sends exactly one packet.
+//
+// Close() must unblock a pending Read()
+type HciDevice interface {
+	Read(packet []byte) (int, error)
+	Write(packet []byte) (int, error)
+	Close() error
+}
+
+// RunSocket() is like Run(), but opens a raw HCI socket to the given adapter (0 = hci0)
+// instead of relying on hcitool & hcidump. re-opens the socket if it fails.
+func RunSocket(ctx context.Context, deviceId int, frameReceived func(Frame)) {
+	log := logger.New("hcisocket")
+	log.Info("starting")
+	defer log.Info("stopped")
+
+	for {
+		err := func() error {
+			device, err := OpenHciDevice(deviceId)
+			if err != nil {
+				return err
+			}
+
+			return RunWithDevice(ctx, device, frameReceived)
+		}()
+
+		select {
+		case <-ctx.Done(): // exited due to context cancel?
+			return
+		default:
+		}
+
+		log.Error(fmt.Sprintf("restarting due to unexpected exit: %s", err.Error()))
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// enables passive LE scanning (with duplicates) on the device and emits each inbound
+// frame until ctx is cancelled (=> returns nil) or reading fails. closes the device.
+func RunWithDevice(ctx context.Context, device HciDevice, frameReceived func(Frame)) error {
+	// disable first, because setting scan parameters fails if scan is left enabled
+	// (e.g. by a previous crashed instance). error response for this is harmless.
+	startScan := [][]byte{
+		leSetScanEnableCommand(false),
+		leSetScanParametersCommand(),
+		leSetScanEnableCommand(true),
+	}
+
+	for _, command := range startScan {
+		if _, err := device.Write(command); err != nil {
+			device.Close()
+			return fmt.Errorf("RunWithDevice: %s", err.Error())
+		}
+	}
+
+	readerExited := make(chan error, 1)
+
+	go func() {
+		readerExited <- readFrames(device, frameReceived)
+	}()
+
+	select {
+	case <-ctx.Done():
+		// best effort. Close() also works as a stop signal for the reader
+		_, errStop := device.Write(leSetScanEnableCommand(false))
+
+		device.Close()
+
+		<-readerExited
+
+		return errStop
+	case err := <-readerExited:
+		device.Close()
+
+		return err
+	}
+}
+
+func readFrames(device HciDevice, frameReceived func(Frame)) error {
+	buf := make([]byte, hciMaxFrameSize)
+
+	for {
+		n, err := device.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		// socket is filtered to only give us events, and those are always inbound.
+		// copy because receiver is allowed to retain the frame.
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		frameReceived(Frame{
+			Direction: HciDumpDirectionInbound,
+			Data:      data,
+			Time:      time.Now(),
+		})
+	}
+}
+
+func hciCommand(opcode uint16, params ...byte) []byte {
+	packet := []byte{hciCommandPkt, 0, 0, byte(len(params))}
+	binary.LittleEndian.PutUint16(packet[1:3], opcode)
+
+	return append(packet, params...)
+}
+
+func leSetScanParametersCommand() []byte {
+	params := make([]byte, 7)
+	params[0] = 0x00 // passive scanning
+	binary.LittleEndian.PutUint16(params[1:3], leScanInterval)
+	binary.LittleEndian.PutUint16(params[3:5], leScanWindow)
+	params[5] = 0x00 // own address type: public
+	params[6] = 0x00 // accept all advertisements
+
+	return hciCommand(opcodeLeSetScanParameters, params...)
+}
+
+func leSetScanEnableCommand(enable bool) []byte {
+	enableByte := byte(0x00)
+	if enable {
+		enableByte = 0x01
+	}
+
+	// second param: don't filter duplicates, since we want every measurement
+	return hciCommand(opcodeLeSetScanEnable, enableByte, 0x00)
+}
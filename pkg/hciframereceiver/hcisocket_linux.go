@@ -0,0 +1,47 @@
+package hciframereceiver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+const (
+	hciFilterSockopt = 2 // HCI_FILTER in <bluetooth/hci.h>
+)
+
+// opens a raw HCI socket to adapter hci<deviceId>. needs CAP_NET_RAW (or root)
+func OpenHciDevice(deviceId int) (HciDevice, error) {
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+	if err != nil {
+		return nil, fmt.Errorf("OpenHciDevice: socket: %s", err.Error())
+	}
+
+	// struct hci_ufilter. in host byte order, which is little endian on all our targets
+	filter := make([]byte, 16)
+	binary.LittleEndian.PutUint32(filter[0:4], 1<<hciEventPkt) // packet types: only events
+	binary.LittleEndian.PutUint32(filter[4:8], 0xffffffff)     // all events
+	binary.LittleEndian.PutUint32(filter[8:12], 0xffffffff)
+
+	if err := unix.SetsockoptString(fd, unix.SOL_HCI, hciFilterSockopt, string(filter)); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("OpenHciDevice: setsockopt: %s", err.Error())
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrHCI{
+		Dev:     uint16(deviceId),
+		Channel: unix.HCI_CHANNEL_RAW,
+	}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("OpenHciDevice: bind hci%d: %s", deviceId, err.Error())
+	}
+
+	// non-blocking so os.File uses the runtime poller, and thus Close() unblocks Read()
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("OpenHciDevice: %s", err.Error())
+	}
+
+	return os.NewFile(uintptr(fd), fmt.Sprintf("hci%d", deviceId)), nil
+}
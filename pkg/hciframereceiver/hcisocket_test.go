@@ -0,0 +1,105 @@
+package hciframereceiver
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortestdata"
+	"github.com/function61/ruuvinator/pkg/utils"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// replays recorded frames and then blocks until closed, like an idle adapter would
+type fakeDevice struct {
+	frames  [][]byte
+	written [][]byte
+	closed  chan interface{}
+	mu      sync.Mutex
+}
+
+func newFakeDevice(frames [][]byte) *fakeDevice {
+	return &fakeDevice{
+		frames: frames,
+		closed: make(chan interface{}),
+	}
+}
+
+func (f *fakeDevice) Read(packet []byte) (int, error) {
+	f.mu.Lock()
+	if len(f.frames) > 0 {
+		frame := f.frames[0]
+		f.frames = f.frames[1:]
+		f.mu.Unlock()
+
+		return copy(packet, frame), nil
+	}
+	f.mu.Unlock()
+
+	<-f.closed
+
+	return 0, errors.New("device closed")
+}
+
+func (f *fakeDevice) Write(packet []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.written = append(f.written, packet)
+
+	return len(packet), nil
+}
+
+func (f *fakeDevice) Close() error {
+	close(f.closed)
+	return nil
+}
+
+func TestRunWithDevice(t *testing.T) {
+	recorded := [][]byte{}
+
+	err := ParseStream(strings.NewReader(ruuvinatortestdata.DemoStream), func(frame Frame) {
+		if frame.Direction == HciDumpDirectionInbound {
+			recorded = append(recorded, frame.Data)
+		}
+	})
+	assert.True(t, err == nil)
+	assert.True(t, len(recorded) == 12)
+
+	device := newFakeDevice(recorded)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := []Frame{}
+
+	err = RunWithDevice(ctx, device, func(frame Frame) {
+		received = append(received, frame)
+
+		if len(received) == len(recorded) {
+			cancel()
+		}
+	})
+	assert.True(t, err == nil)
+
+	assert.True(t, len(received) == len(recorded))
+	for i, frame := range received {
+		assert.True(t, frame.Direction == HciDumpDirectionInbound)
+		assert.True(t, bytes.Equal(frame.Data, recorded[i]))
+	}
+
+	assertWritten := func(packet []byte, expected string) {
+		t.Helper()
+
+		assert.EqualString(t, strings.ToUpper(utils.SplitStringIntoGroupsOfTwo(hex.EncodeToString(packet), " ")), expected)
+	}
+
+	assert.True(t, len(device.written) == 4)
+	assertWritten(device.written[0], "01 0C 20 02 00 00")
+	assertWritten(device.written[1], "01 0B 20 07 00 10 00 10 00 00 00")
+	assertWritten(device.written[2], "01 0C 20 02 01 00")
+	assertWritten(device.written[3], "01 0C 20 02 00 00")
+}
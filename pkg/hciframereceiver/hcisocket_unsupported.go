@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package hciframereceiver
+
+import (
+	"errors"
+)
+
+func OpenHciDevice(deviceId int) (HciDevice, error) {
+	return nil, errors.New("OpenHciDevice: raw HCI sockets are only supported on Linux")
+}
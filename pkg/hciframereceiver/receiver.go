@@ -13,6 +13,7 @@ import (
 type Frame struct {
 	Direction HciDumpDirection
 	Data      []byte
+	Time      time.Time // when the frame was received. zero if not known
 }
 
 type HciDumpDirection int
@@ -64,22 +65,28 @@ func hciDumper(ctx context.Context, frameReceived func(Frame), stop *stopper.Sto
 	log.Info("starting")
 	defer log.Info("stopped")
 
-	hciDumper := exec.CommandContext(ctx, "hcidump", "--raw")
+	// "-t" so frames carry their capture time. we can't stamp them ourselves, because a frame
+	// is known to be complete only once the next one arrives
+	hciDumper := exec.CommandContext(ctx, "hcidump", "--raw", "-t")
 	hciDumper.Stderr = os.Stderr
 	hciDumperOutput, err := hciDumper.StdoutPipe()
 	if err != nil {
 		panic(err)
 	}
 
-	go func() {
-		// write hciDumperOutput to parser which will invoke frameReceived
-		// for each received frame
-		if err := ParseStream(hciDumperOutput, frameReceived); err != nil {
-			log.Error(fmt.Sprintf("hcidumpOutputParser: %s", err))
-		}
-	}()
+	if err := hciDumper.Start(); err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	// write hciDumperOutput to parser which will invoke frameReceived for each received
+	// frame. not in a goroutine, so that frameReceived is never called after we return
+	// (our caller closes the outputs then)
+	if err := ParseStream(hciDumperOutput, frameReceived); err != nil {
+		log.Error(fmt.Sprintf("hcidumpOutputParser: %s", err))
+	}
 
-	if err := hciDumper.Run(); err != nil {
+	if err := hciDumper.Wait(); err != nil {
 		log.Error(err.Error())
 	}
 }
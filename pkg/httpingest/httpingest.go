@@ -0,0 +1,66 @@
+package httpingest
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"io"
+	"net/http"
+)
+
+const (
+	maxBodyBytes = 10 * 1024 * 1024 // after decompression
+)
+
+// accepts the same JSON array of observations that sqsoutput sends, POSTed by httpoutput.
+// requests must have "Authorization: Bearer <token>". body can be gzipped.
+func New(token string, observe func(ruuvinatortypes.ResolvedSensorObservation)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST expected", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !tokenOk(r, token) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		var body io.Reader = r.Body
+
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gzipReader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer gzipReader.Close()
+
+			body = gzipReader
+		}
+
+		observations := []ruuvinatortypes.ResolvedSensorObservation{}
+		if err := json.NewDecoder(io.LimitReader(body, maxBodyBytes)).Decode(&observations); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, observation := range observations {
+			observe(observation)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func tokenOk(r *http.Request, token string) bool {
+	// empty token would let anybody in
+	if token == "" {
+		return false
+	}
+
+	expected := "Bearer " + token
+
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
@@ -0,0 +1,45 @@
+package httpingest
+
+import (
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIngest(t *testing.T) {
+	observed := []string{}
+
+	handler := New("s3cret", func(observation ruuvinatortypes.ResolvedSensorObservation) {
+		observed = append(observed, observation.SensorName)
+	})
+
+	ingest := func(token string, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		return resp.Code
+	}
+
+	assert.True(t, ingest("wrong", `[{"sensor_name":"Sauna"}]`) == http.StatusUnauthorized)
+	assert.True(t, ingest("s3cret", `{"not":"an array"}`) == http.StatusBadRequest)
+	assert.True(t, len(observed) == 0)
+
+	assert.True(t, ingest("s3cret", `[{"sensor_name":"Sauna"},{"sensor_name":"Fridge"}]`) == http.StatusNoContent)
+	assert.EqualString(t, strings.Join(observed, ","), "Sauna,Fridge")
+}
+
+func TestEmptyTokenDeniesEverything(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(`[]`))
+	req.Header.Set("Authorization", "Bearer ")
+
+	resp := httptest.NewRecorder()
+	New("", func(ruuvinatortypes.ResolvedSensorObservation) {}).ServeHTTP(resp, req)
+
+	assert.True(t, resp.Code == http.StatusUnauthorized)
+}
@@ -7,17 +7,27 @@ import (
 )
 
 type output struct {
-	ch chan ruuvinatortypes.ResolvedSensorObservation
+	ch      chan ruuvinatortypes.ResolvedSensorObservation
+	stopped chan interface{}
 }
 
 func (o *output) GetObservationsChan() chan<- ruuvinatortypes.ResolvedSensorObservation {
 	return o.ch
 }
 
+func (o *output) Close() {
+	close(o.ch)
+
+	<-o.stopped
+}
+
 func New() *output {
 	ch := make(chan ruuvinatortypes.ResolvedSensorObservation, 1)
+	stopped := make(chan interface{})
 
 	go func() {
+		defer close(stopped)
+
 		for observation := range ch {
 			observationAsJson, _ := json.Marshal(observation)
 
@@ -26,6 +36,7 @@ func New() *output {
 	}()
 
 	return &output{
-		ch: ch,
+		ch:      ch,
+		stopped: stopped,
 	}
 }
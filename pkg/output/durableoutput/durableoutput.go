@@ -0,0 +1,212 @@
+package durableoutput
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/function61/gokit/logger"
+	"github.com/function61/ruuvinator/pkg/diskqueue"
+	"github.com/function61/ruuvinator/pkg/output/observationbatch"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"time"
+)
+
+var log = logger.New("durable-output")
+
+const (
+	maxObservationsPerBatch = 100
+	// limits number of writes (= service charges for SQS) when there's a backlog
+	defaultWriteInterval = 2 * time.Second
+	defaultRetryInterval = 10 * time.Second
+)
+
+// writes observations to an on-disk queue first, and forgets them only after the wrapped
+// output has delivered them. this way observations survive network outages and restarts.
+type output struct {
+	queue           *diskqueue.Queue
+	destination     ruuvinatortypes.BatchOutput
+	writeInterval   time.Duration
+	retryInterval   time.Duration
+	observations    chan ruuvinatortypes.ResolvedSensorObservation
+	appenderStopped chan interface{}
+	stopped         chan interface{}
+}
+
+func (o *output) GetObservationsChan() chan<- ruuvinatortypes.ResolvedSensorObservation {
+	return o.observations
+}
+
+// delivers what it can without waiting for retries. rest stays on disk for next start.
+func (o *output) Close() {
+	close(o.observations)
+
+	<-o.stopped
+}
+
+// doesn't stop on ctx cancellation, so observations given before Close() end up on disk
+func (o *output) appender() {
+	defer close(o.appenderStopped)
+
+	for firstItem := range o.observations {
+		observations := observationbatch.ReadMoreUnblocking(maxObservationsPerBatch, firstItem, o.observations)
+
+		records := [][]byte{}
+
+		for _, observation := range observations {
+			observationAsJson, err := json.Marshal(observation)
+			if err != nil {
+				panic(err)
+			}
+
+			records = append(records, observationAsJson)
+		}
+
+		if err := o.queue.Append(records); err != nil {
+			log.Error(fmt.Sprintf("dropping %d observations: %s", len(records), err.Error()))
+		}
+	}
+}
+
+func (o *output) deliverer(ctx context.Context) {
+	closing := false
+
+	for {
+		entries, err := o.queue.Read(maxObservationsPerBatch)
+		if err != nil {
+			log.Error(fmt.Sprintf("Read: %s", err.Error()))
+
+			if !o.waitForRetry(ctx) {
+				return
+			}
+
+			continue
+		}
+
+		if len(entries) == 0 {
+			if closing {
+				return // everything delivered
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-o.appenderStopped:
+				closing = true
+			case <-o.queue.Appended():
+			}
+
+			continue
+		}
+
+		observations := []ruuvinatortypes.ResolvedSensorObservation{}
+
+		for _, entry := range entries {
+			observation := ruuvinatortypes.ResolvedSensorObservation{}
+			if err := json.Unmarshal(entry.Data, &observation); err != nil {
+				log.Error(fmt.Sprintf("skipping corrupted observation: %s", err.Error()))
+				continue
+			}
+
+			observations = append(observations, observation)
+		}
+
+		nextPossibleWrite := time.Now().Add(o.writeInterval)
+
+		if len(observations) > 0 {
+			if err := o.destination.WriteBatch(ctx, observations); err != nil {
+				if ruuvinatortypes.IsPermanentError(err) {
+					// would block the queue forever. commit past it
+					log.Error(fmt.Sprintf("dropping %d observations: %s", len(observations), err.Error()))
+				} else {
+					log.Error(fmt.Sprintf("WriteBatch: %s", err.Error()))
+
+					if !o.waitForRetry(ctx) {
+						return
+					}
+
+					continue
+				}
+			}
+		}
+
+		if err := o.queue.Commit(entries[len(entries)-1]); err != nil {
+			log.Error(fmt.Sprintf("Commit: %s", err.Error()))
+		}
+
+		if closing {
+			continue // flush rest as fast as we can
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.appenderStopped:
+			closing = true
+		case <-time.After(time.Until(nextPossibleWrite)):
+		}
+	}
+}
+
+// returns false if we should stop instead. when closing we don't wait for the destination
+// to recover, as the rest will be delivered on next start anyway
+func (o *output) waitForRetry(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-o.appenderStopped:
+		return false
+	case <-time.After(o.retryInterval):
+		return true
+	}
+}
+
+func New(
+	ctx context.Context,
+	config ruuvinatortypes.DurableQueueConfig,
+	destination ruuvinatortypes.BatchOutput,
+) (*output, error) {
+	queue, err := diskqueue.Open(config.Directory, config.MaxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return start(ctx, queue, destination, defaultWriteInterval, defaultRetryInterval), nil
+}
+
+func start(
+	ctx context.Context,
+	queue *diskqueue.Queue,
+	destination ruuvinatortypes.BatchOutput,
+	writeInterval time.Duration,
+	retryInterval time.Duration,
+) *output {
+	out := &output{
+		queue:           queue,
+		destination:     destination,
+		writeInterval:   writeInterval,
+		retryInterval:   retryInterval,
+		observations:    make(chan ruuvinatortypes.ResolvedSensorObservation, maxObservationsPerBatch),
+		appenderStopped: make(chan interface{}),
+		stopped:         make(chan interface{}),
+	}
+
+	go out.appender()
+
+	go func() {
+		log.Info("starting")
+		defer log.Info("stopped")
+		defer close(out.stopped)
+
+		out.deliverer(ctx)
+
+		destination.Close()
+
+		<-out.appenderStopped // so nothing is appended anymore
+
+		if err := queue.Close(); err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
+	return out
+}
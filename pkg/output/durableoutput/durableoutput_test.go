@@ -0,0 +1,227 @@
+package durableoutput
+
+import (
+	"context"
+	"errors"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/diskqueue"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeliversInOrderAfterOutage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durableoutput")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	destination := newTestDestination()
+	destination.setUp(false)
+
+	out := startTestOutput(t, dir, destination)
+
+	send(out, "a", "b", "c")
+
+	// all writes fail => nothing delivered, but nothing lost either
+	destination.waitForAttempts(t, 2)
+	assert.EqualString(t, destination.deliveredNames(), "")
+
+	destination.setUp(true)
+
+	send(out, "d")
+
+	destination.waitForDelivered(t, 4)
+	assert.EqualString(t, destination.deliveredNames(), "a,b,c,d")
+
+	out.Close()
+	assert.True(t, destination.closed)
+}
+
+func TestUndeliveredSurviveRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durableoutput")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	destination := newTestDestination()
+	destination.setUp(false)
+
+	out := startTestOutput(t, dir, destination)
+
+	send(out, "a", "b")
+
+	destination.waitForAttempts(t, 1)
+
+	out.Close()
+
+	// "restart"
+	destination = newTestDestination()
+
+	out = startTestOutput(t, dir, destination)
+
+	send(out, "c")
+
+	destination.waitForDelivered(t, 3)
+	assert.EqualString(t, destination.deliveredNames(), "a,b,c")
+
+	out.Close()
+}
+
+func TestPermanentlyRejectedBatchIsDropped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durableoutput")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	destination := newTestDestination()
+	destination.setRejecting(true)
+
+	out := startTestOutput(t, dir, destination)
+
+	send(out, "a", "b")
+
+	destination.waitForRejected(t, 2)
+
+	destination.setRejecting(false)
+
+	send(out, "c")
+
+	// would be stuck retrying "a" and "b" if they weren't committed past
+	destination.waitForDelivered(t, 1)
+	assert.EqualString(t, destination.deliveredNames(), "c")
+
+	out.Close()
+
+	// nor are they replayed on restart
+	destination = newTestDestination()
+
+	out = startTestOutput(t, dir, destination)
+
+	send(out, "d")
+
+	destination.waitForDelivered(t, 1)
+	assert.EqualString(t, destination.deliveredNames(), "d")
+
+	out.Close()
+}
+
+func startTestOutput(t *testing.T, dir string, destination *testDestination) *output {
+	queue, err := diskqueue.Open(dir, 0)
+	assert.True(t, err == nil)
+
+	return start(context.Background(), queue, destination, 0, 10*time.Millisecond)
+}
+
+func send(out *output, sensorNames ...string) {
+	for _, sensorName := range sensorNames {
+		out.GetObservationsChan() <- ruuvinatortypes.ResolvedSensorObservation{
+			SensorName: sensorName,
+		}
+	}
+}
+
+type testDestination struct {
+	mu        sync.Mutex
+	up        bool
+	rejecting bool
+	attempts  int
+	rejected  int
+	delivered []string
+	closed    bool
+}
+
+func newTestDestination() *testDestination {
+	return &testDestination{up: true}
+}
+
+func (d *testDestination) GetObservationsChan() chan<- ruuvinatortypes.ResolvedSensorObservation {
+	panic("not used")
+}
+
+func (d *testDestination) Close() {
+	d.closed = true
+}
+
+func (d *testDestination) WriteBatch(ctx context.Context, batch []ruuvinatortypes.ResolvedSensorObservation) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.attempts++
+
+	if !d.up {
+		return errors.New("network unreachable")
+	}
+
+	if d.rejecting {
+		d.rejected += len(batch)
+		return ruuvinatortypes.NewPermanentError(errors.New("bad request"))
+	}
+
+	for _, observation := range batch {
+		d.delivered = append(d.delivered, observation.SensorName)
+	}
+
+	return nil
+}
+
+func (d *testDestination) setUp(up bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.up = up
+}
+
+func (d *testDestination) setRejecting(rejecting bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rejecting = rejecting
+}
+
+func (d *testDestination) deliveredNames() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return strings.Join(d.delivered, ",")
+}
+
+func (d *testDestination) waitForAttempts(t *testing.T, attempts int) {
+	waitFor(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		return d.attempts >= attempts
+	})
+}
+
+func (d *testDestination) waitForRejected(t *testing.T, rejected int) {
+	waitFor(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		return d.rejected >= rejected
+	})
+}
+
+func (d *testDestination) waitForDelivered(t *testing.T, delivered int) {
+	waitFor(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		return len(d.delivered) >= delivered
+	})
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 500; i++ {
+		if condition() {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("timed out")
+}
@@ -0,0 +1,206 @@
+package fanoutput
+
+import (
+	"context"
+	"fmt"
+	"github.com/function61/gokit/logger"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"sync"
+	"time"
+)
+
+var log = logger.New("fan-output")
+
+const (
+	// if an output can't keep up with this much backlog, we start dropping its observations
+	// instead of blocking the others (and the Bluetooth receive loop)
+	bufferSizePerOutput = 1000
+	// once ctx is cancelled, how long we still wait for a destination to take our buffered
+	// observations. it might have stopped reading, but usually it hasn't.
+	shutdownGracePeriod = 5 * time.Second
+)
+
+type Destination struct {
+	Name   string // for logging
+	Output ruuvinatortypes.Output
+}
+
+// delivers each observation to every destination independently. each destination has its
+// own buffer, so a slow or failing one doesn't block the others. destinations can be added
+// and removed while running.
+type output struct {
+	ctx          context.Context
+	gracePeriod  time.Duration
+	observations chan ruuvinatortypes.ResolvedSensorObservation
+	queuesMu     sync.Mutex
+	queues       []*destinationQueue
+	stopped      chan interface{}
+}
+
+func (o *output) GetObservationsChan() chan<- ruuvinatortypes.ResolvedSensorObservation {
+	return o.observations
+}
+
+func (o *output) Close() {
+	close(o.observations)
+
+	<-o.stopped
+}
+
+// starts delivering to destinations
+func (o *output) Add(destinations []Destination) {
+	o.queuesMu.Lock()
+	defer o.queuesMu.Unlock()
+
+	for _, destination := range destinations {
+		queue := &destinationQueue{
+			Destination: destination,
+			queue:       make(chan ruuvinatortypes.ResolvedSensorObservation, bufferSizePerOutput),
+			stopped:     make(chan interface{}),
+		}
+
+		o.queues = append(o.queues, queue)
+
+		go queue.forwarder(o.ctx, o.gracePeriod)
+	}
+}
+
+// stops delivering to outputs, and returns once they have been closed
+func (o *output) Remove(outputs []ruuvinatortypes.Output) {
+	removed := []*destinationQueue{}
+
+	o.queuesMu.Lock()
+
+	kept := []*destinationQueue{}
+	for _, queue := range o.queues {
+		if containsOutput(outputs, queue.Output) {
+			removed = append(removed, queue)
+		} else {
+			kept = append(kept, queue)
+		}
+	}
+	o.queues = kept
+
+	o.queuesMu.Unlock()
+
+	closeAndWait(removed)
+}
+
+type destinationQueue struct {
+	Destination
+	queue   chan ruuvinatortypes.ResolvedSensorObservation
+	dropped int // number of observations dropped in current streak of full buffer
+	stopped chan interface{}
+}
+
+func (d *destinationQueue) offer(observation ruuvinatortypes.ResolvedSensorObservation) {
+	select {
+	case d.queue <- observation:
+		if d.dropped > 0 {
+			log.Info(fmt.Sprintf("%s: caught up; dropped %d observations", d.Name, d.dropped))
+			d.dropped = 0
+		}
+	default:
+		if d.dropped == 0 {
+			log.Error(fmt.Sprintf("%s: buffer full; dropping observations", d.Name))
+		}
+		d.dropped++
+	}
+}
+
+// forwards observations from our buffer to the destination, and closes the destination once
+// our buffer is closed and drained. after ctx is cancelled the destination might have stopped
+// reading, so from then on we wait for it only until gracePeriod is over.
+func (d *destinationQueue) forwarder(ctx context.Context, gracePeriod time.Duration) {
+	defer close(d.stopped)
+	defer d.Output.Close()
+
+	observationsCh := d.Output.GetObservationsChan()
+
+	cancelled := ctx.Done()
+	var gracePeriodOver <-chan time.Time // armed once ctx is cancelled
+
+	deliver := func(observation ruuvinatortypes.ResolvedSensorObservation) bool {
+		for {
+			select {
+			case observationsCh <- observation:
+				return true
+			case <-cancelled:
+				cancelled = nil
+				gracePeriodOver = time.After(gracePeriod)
+			case <-gracePeriodOver:
+				return false
+			}
+		}
+	}
+
+	undelivered := 0
+
+	for observation := range d.queue {
+		// after giving up once, just drain our buffer
+		if undelivered > 0 || !deliver(observation) {
+			undelivered++
+		}
+	}
+
+	if undelivered > 0 {
+		log.Error(fmt.Sprintf("%s: stopped reading; dropped %d observations", d.Name, undelivered))
+	}
+}
+
+func New(ctx context.Context, destinations []Destination) *output {
+	return start(ctx, destinations, shutdownGracePeriod)
+}
+
+func start(ctx context.Context, destinations []Destination, gracePeriod time.Duration) *output {
+	out := &output{
+		ctx:          ctx,
+		gracePeriod:  gracePeriod,
+		observations: make(chan ruuvinatortypes.ResolvedSensorObservation, 1),
+		stopped:      make(chan interface{}),
+	}
+
+	out.Add(destinations)
+
+	go func() {
+		defer close(out.stopped)
+
+		for observation := range out.observations {
+			out.queuesMu.Lock()
+			for _, queue := range out.queues {
+				queue.offer(observation)
+			}
+			out.queuesMu.Unlock()
+		}
+
+		out.queuesMu.Lock()
+		queues := out.queues
+		out.queues = nil
+		out.queuesMu.Unlock()
+
+		closeAndWait(queues)
+	}()
+
+	return out
+}
+
+// closed queues are drained and then their destinations closed
+func closeAndWait(queues []*destinationQueue) {
+	for _, queue := range queues {
+		close(queue.queue)
+	}
+
+	for _, queue := range queues {
+		<-queue.stopped
+	}
+}
+
+func containsOutput(outputs []ruuvinatortypes.Output, output ruuvinatortypes.Output) bool {
+	for _, candidate := range outputs {
+		if candidate == output {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,190 @@
+package fanoutput
+
+import (
+	"context"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testOutput struct {
+	observations chan ruuvinatortypes.ResolvedSensorObservation
+	received     []ruuvinatortypes.ResolvedSensorObservation
+	receivedMu   sync.Mutex
+	stopped      chan interface{}
+}
+
+func (t *testOutput) receivedCount() int {
+	t.receivedMu.Lock()
+	defer t.receivedMu.Unlock()
+
+	return len(t.received)
+}
+
+func (t *testOutput) GetObservationsChan() chan<- ruuvinatortypes.ResolvedSensorObservation {
+	return t.observations
+}
+
+func (t *testOutput) Close() {
+	close(t.observations)
+
+	<-t.stopped
+}
+
+// starts reading only after unblock is closed. like real outputs, stops on ctx cancel
+func newTestOutput(ctx context.Context, unblock chan interface{}) *testOutput {
+	out := &testOutput{
+		observations: make(chan ruuvinatortypes.ResolvedSensorObservation),
+		stopped:      make(chan interface{}),
+	}
+
+	go func() {
+		defer close(out.stopped)
+
+		select {
+		case <-unblock:
+		case <-ctx.Done():
+			return
+		}
+
+		for observation := range out.observations {
+			out.receivedMu.Lock()
+			out.received = append(out.received, observation)
+			out.receivedMu.Unlock()
+		}
+	}()
+
+	return out
+}
+
+func TestSlowOutputDoesNotBlockOthers(t *testing.T) {
+	unblocked := make(chan interface{})
+	close(unblocked)
+
+	blocked := make(chan interface{})
+
+	fast := newTestOutput(context.Background(), unblocked)
+	slow := newTestOutput(context.Background(), blocked)
+
+	fanout := New(context.Background(), []Destination{
+		{Name: "fast", Output: fast},
+		{Name: "slow", Output: slow},
+	})
+
+	observationsCh := fanout.GetObservationsChan()
+
+	send := func(count int) {
+		for i := 0; i < count; i++ {
+			observationsCh <- ruuvinatortypes.ResolvedSensorObservation{SensorName: "Bedroom"}
+		}
+	}
+
+	// fills slow's buffer
+	send(bufferSizePerOutput)
+
+	// fast is not held back by slow
+	waitForReceived(t, fast, bufferSizePerOutput)
+
+	// slow has to drop these, but we must not block
+	send(10)
+
+	close(blocked)
+
+	fanout.Close()
+
+	assert.True(t, fast.receivedCount() == bufferSizePerOutput+10)
+	assert.True(t, slow.receivedCount() >= bufferSizePerOutput)
+	assert.True(t, slow.receivedCount() < bufferSizePerOutput+10)
+}
+
+func TestCloseWithStuckOutput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stuck := newTestOutput(ctx, make(chan interface{})) // never reads
+
+	fanout := start(ctx, []Destination{
+		{Name: "stuck", Output: stuck},
+	}, 10*time.Millisecond)
+
+	fanout.GetObservationsChan() <- ruuvinatortypes.ResolvedSensorObservation{}
+
+	cancel()
+
+	// must not block on delivering to stuck
+	fanout.Close()
+
+	assert.True(t, len(stuck.received) == 0)
+}
+
+func TestCloseAfterCancelDeliversBuffered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	unblock := make(chan interface{})
+
+	// doesn't stop on our ctx, so it keeps reading after cancel
+	reading := newTestOutput(context.Background(), unblock)
+
+	fanout := New(ctx, []Destination{
+		{Name: "reading", Output: reading},
+	})
+
+	for i := 0; i < 100; i++ {
+		fanout.GetObservationsChan() <- ruuvinatortypes.ResolvedSensorObservation{SensorName: "Bedroom"}
+	}
+
+	cancel()
+
+	close(unblock)
+
+	fanout.Close()
+
+	assert.True(t, reading.receivedCount() == 100)
+}
+
+func TestAddAndRemove(t *testing.T) {
+	unblocked := make(chan interface{})
+	close(unblocked)
+
+	first := newTestOutput(context.Background(), unblocked)
+	second := newTestOutput(context.Background(), unblocked)
+
+	fanout := New(context.Background(), []Destination{
+		{Name: "first", Output: first},
+	})
+
+	fanout.GetObservationsChan() <- ruuvinatortypes.ResolvedSensorObservation{SensorName: "Bedroom"}
+
+	waitForReceived(t, first, 1) // so second doesn't get it
+
+	fanout.Add([]Destination{
+		{Name: "second", Output: second},
+	})
+
+	fanout.GetObservationsChan() <- ruuvinatortypes.ResolvedSensorObservation{SensorName: "Bedroom"}
+
+	waitForReceived(t, second, 1)
+
+	// returns once first is closed, so all it got is counted
+	fanout.Remove([]ruuvinatortypes.Output{first})
+
+	fanout.GetObservationsChan() <- ruuvinatortypes.ResolvedSensorObservation{SensorName: "Bedroom"}
+
+	fanout.Close()
+
+	assert.True(t, first.receivedCount() == 2)
+	assert.True(t, second.receivedCount() == 2)
+}
+
+func waitForReceived(t *testing.T, out *testOutput, count int) {
+	for i := 0; i < 500; i++ {
+		if out.receivedCount() == count {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("timed out")
+}
@@ -0,0 +1,174 @@
+package httpoutput
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/function61/gokit/logger"
+	"github.com/function61/gokit/retry"
+	"github.com/function61/ruuvinator/pkg/output/observationbatch"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+var log = logger.New("http-output")
+
+const (
+	maxObservationsPerRequest = 100
+	writeTimeout              = 10 * time.Second
+)
+
+// POSTs observations in batches (as gzipped JSON) to metricsserver's ingest endpoint
+type output struct {
+	config       ruuvinatortypes.HttpOutputConfig
+	httpClient   *http.Client
+	observations chan ruuvinatortypes.ResolvedSensorObservation
+	stopped      chan interface{}
+}
+
+func (o *output) GetObservationsChan() chan<- ruuvinatortypes.ResolvedSensorObservation {
+	return o.observations
+}
+
+func (o *output) Close() {
+	close(o.observations)
+
+	<-o.stopped
+}
+
+func (o *output) processor(ctx context.Context) {
+	log.Info("starting")
+	defer log.Info("stopped")
+	defer close(o.stopped)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case firstItem, ok := <-o.observations:
+			if !ok { // closed => everything was sent
+				return
+			}
+
+			observations := observationbatch.ReadMoreUnblocking(maxObservationsPerRequest, firstItem, o.observations)
+
+			// at most one request per second, so we get bigger batches
+			nextPossibleWrite := time.Now().Add(1 * time.Second)
+
+			if err := o.WriteBatch(ctx, observations); err != nil {
+				log.Error(fmt.Sprintf("dropping %d observations: %s", len(observations), err.Error()))
+			}
+
+			time.Sleep(time.Until(nextPossibleWrite))
+		}
+	}
+}
+
+func (o *output) WriteBatch(ctx context.Context, observations []ruuvinatortypes.ResolvedSensorObservation) error {
+	body, err := gzipJson(observations)
+	if err != nil {
+		return ruuvinatortypes.NewPermanentError(err)
+	}
+
+	ctxRetry, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	var rejected error
+
+	err = retry.Retry(
+		ctxRetry,
+		func(ctx context.Context) error {
+			err := o.post(ctx, body)
+			if ruuvinatortypes.IsPermanentError(err) {
+				rejected = err
+				return nil // retrying wouldn't help
+			}
+
+			return err
+		},
+		retry.DefaultBackoff(),
+		func(err error) {
+			log.Error(fmt.Sprintf("post: %s", err.Error()))
+		})
+	if rejected != nil {
+		return rejected
+	}
+
+	return err
+}
+
+func (o *output) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, o.config.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Authorization", "Bearer "+o.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		err := fmt.Errorf("HTTP %s: %s", resp.Status, respBody)
+
+		if batchRejected(resp.StatusCode) {
+			return ruuvinatortypes.NewPermanentError(err)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// 4xx is about the request itself, except these that go away by waiting
+func batchRejected(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	default:
+		return statusCode >= 400 && statusCode < 500
+	}
+}
+
+func gzipJson(observations []ruuvinatortypes.ResolvedSensorObservation) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	gzipWriter := gzip.NewWriter(buf)
+
+	if err := json.NewEncoder(gzipWriter).Encode(observations); err != nil {
+		return nil, err
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func New(ctx context.Context, config ruuvinatortypes.HttpOutputConfig) *output {
+	out := &output{
+		config:     config,
+		httpClient: &http.Client{Timeout: writeTimeout},
+		observations: make(
+			chan ruuvinatortypes.ResolvedSensorObservation,
+			maxObservationsPerRequest*2),
+		stopped: make(chan interface{}),
+	}
+
+	go out.processor(ctx)
+
+	return out
+}
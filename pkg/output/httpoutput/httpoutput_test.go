@@ -0,0 +1,82 @@
+package httpoutput
+
+import (
+	"context"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/httpingest"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPushesToIngest(t *testing.T) {
+	observedMu := sync.Mutex{}
+	observed := []string{}
+
+	server := httptest.NewServer(httpingest.New("s3cret", func(observation ruuvinatortypes.ResolvedSensorObservation) {
+		observedMu.Lock()
+		defer observedMu.Unlock()
+
+		observed = append(observed, observation.SensorName)
+	}))
+	defer server.Close()
+
+	out := New(context.Background(), ruuvinatortypes.HttpOutputConfig{
+		Url:   server.URL + "/ingest",
+		Token: "s3cret",
+	})
+
+	assert.True(t, out.WriteBatch(context.Background(), []ruuvinatortypes.ResolvedSensorObservation{
+		{SensorName: "Sauna"},
+		{SensorName: "Fridge"},
+	}) == nil)
+
+	out.Close()
+
+	observedMu.Lock()
+	defer observedMu.Unlock()
+
+	assert.EqualString(t, strings.Join(observed, ","), "Sauna,Fridge")
+}
+
+func TestRejectedIsNotRetried(t *testing.T) {
+	requestsMu := sync.Mutex{}
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsMu.Lock()
+		defer requestsMu.Unlock()
+
+		requests++
+
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	out := New(context.Background(), ruuvinatortypes.HttpOutputConfig{
+		Url:   server.URL + "/ingest",
+		Token: "s3cret",
+	})
+	defer out.Close()
+
+	err := out.WriteBatch(context.Background(), []ruuvinatortypes.ResolvedSensorObservation{
+		{SensorName: "Sauna"},
+	})
+	assert.True(t, ruuvinatortypes.IsPermanentError(err))
+
+	requestsMu.Lock()
+	defer requestsMu.Unlock()
+
+	assert.True(t, requests == 1)
+}
+
+func TestBatchRejected(t *testing.T) {
+	assert.True(t, batchRejected(http.StatusBadRequest))
+	assert.True(t, batchRejected(http.StatusRequestEntityTooLarge))
+	assert.True(t, !batchRejected(http.StatusRequestTimeout))
+	assert.True(t, !batchRejected(http.StatusTooManyRequests))
+	assert.True(t, !batchRejected(http.StatusBadGateway))
+}
@@ -0,0 +1,286 @@
+package influxoutput
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/function61/gokit/logger"
+	"github.com/function61/gokit/retry"
+	"github.com/function61/ruuvinator/pkg/output/observationbatch"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var log = logger.New("influx-output")
+
+const (
+	maxObservationsPerWrite = 500
+	writeTimeout            = 10 * time.Second
+)
+
+type output struct {
+	config       ruuvinatortypes.InfluxOutputConfig
+	writeUrl     string
+	spool        *spool // nil if spooling not configured
+	httpClient   *http.Client
+	observations chan ruuvinatortypes.ResolvedSensorObservation
+	stopped      chan interface{}
+}
+
+func (o *output) GetObservationsChan() chan<- ruuvinatortypes.ResolvedSensorObservation {
+	return o.observations
+}
+
+func (o *output) Close() {
+	close(o.observations)
+
+	<-o.stopped
+}
+
+func (o *output) processor(ctx context.Context) {
+	log.Info("starting")
+	defer log.Info("stopped")
+	defer close(o.stopped)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case firstItem, ok := <-o.observations:
+			if !ok { // closed => everything was written (or spooled)
+				return
+			}
+
+			observations := observationbatch.ReadMoreUnblocking(maxObservationsPerWrite, firstItem, o.observations)
+
+			// at most one write per second, so we get bigger batches
+			nextPossibleWrite := time.Now().Add(1 * time.Second)
+
+			o.writeOrSpool(ctx, toLineProtocol(observations))
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(nextPossibleWrite)):
+			}
+		}
+	}
+}
+
+func (o *output) writeOrSpool(ctx context.Context, batch []byte) {
+	if o.spool == nil {
+		if err := o.writeWithRetry(ctx, batch); err != nil {
+			log.Error(fmt.Sprintf("dropping %d bytes: %s", len(batch), err.Error()))
+		}
+
+		return
+	}
+
+	// to keep order, spooled ones have to go first
+	if err := o.flushSpool(ctx); err != nil {
+		if err := o.spool.Add(batch); err != nil {
+			log.Error(fmt.Sprintf("spool: %s", err.Error()))
+		}
+
+		return
+	}
+
+	if err := o.writeWithRetry(ctx, batch); err != nil {
+		if isRejected(err) { // would block the spool forever
+			log.Error(fmt.Sprintf("dropping %d bytes: %s", len(batch), err.Error()))
+			return
+		}
+
+		log.Error(fmt.Sprintf("spooling: %s", err.Error()))
+
+		if err := o.spool.Add(batch); err != nil {
+			log.Error(fmt.Sprintf("spool: %s", err.Error()))
+		}
+	}
+}
+
+// used when fronted by a durable queue, so our own spool is not used
+func (o *output) WriteBatch(ctx context.Context, observations []ruuvinatortypes.ResolvedSensorObservation) error {
+	batch := toLineProtocol(observations)
+
+	if err := o.writeWithRetry(ctx, batch); err != nil {
+		if isRejected(err) {
+			return ruuvinatortypes.NewPermanentError(err)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// writes spooled batches oldest first. stops at first failure, but drops batches that
+// InfluxDB rejects (otherwise they would block the ones after them forever)
+func (o *output) flushSpool(ctx context.Context) error {
+	files, err := o.spool.Files()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		batch, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		// no retries here; the spool can wait until next batch
+		if err := o.write(ctx, batch); err != nil {
+			if !isRejected(err) {
+				return err
+			}
+
+			log.Error(fmt.Sprintf("dropping spooled %s: %s", filepath.Base(file), err.Error()))
+		}
+
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+
+	if len(files) > 0 {
+		log.Info(fmt.Sprintf("flushed %d spooled batches", len(files)))
+	}
+
+	return nil
+}
+
+func (o *output) writeWithRetry(ctx context.Context, batch []byte) error {
+	ctxRetry, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	var rejected error
+
+	err := retry.Retry(
+		ctxRetry,
+		func(ctx context.Context) error {
+			err := o.write(ctx, batch)
+			if isRejected(err) {
+				rejected = err
+				return nil // retrying wouldn't help
+			}
+
+			return err
+		},
+		retry.DefaultBackoff(),
+		func(err error) {
+			log.Error(fmt.Sprintf("write: %s", err.Error()))
+		})
+	if rejected != nil {
+		return rejected
+	}
+
+	return err
+}
+
+func (o *output) write(ctx context.Context, batch []byte) error {
+	req, err := http.NewRequest(http.MethodPost, o.writeUrl, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	if o.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+o.config.Token)
+	} else if o.config.Username != "" {
+		req.SetBasicAuth(o.config.Username, o.config.Password)
+	}
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err := fmt.Errorf("write: HTTP %s: %s", resp.Status, body)
+
+		if batchRejected(resp.StatusCode) {
+			return &rejectedError{err}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// InfluxDB won't ever accept the batch (bad line protocol, too large etc.)
+type rejectedError struct {
+	error
+}
+
+func isRejected(err error) bool {
+	_, rejected := err.(*rejectedError)
+	return rejected
+}
+
+// 4xx is about the batch itself, except these that go away once the server or our
+// credentials are fixed (404 = database doesn't exist yet)
+func batchRejected(statusCode int) bool {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusTooManyRequests:
+		return false
+	default:
+		return statusCode >= 400 && statusCode < 500
+	}
+}
+
+func New(ctx context.Context, config ruuvinatortypes.InfluxOutputConfig) (*output, error) {
+	writeUrl, err := makeWriteUrl(config)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &output{
+		config:     config,
+		writeUrl:   writeUrl,
+		httpClient: &http.Client{Timeout: writeTimeout},
+		observations: make(
+			chan ruuvinatortypes.ResolvedSensorObservation,
+			maxObservationsPerWrite*2),
+		stopped: make(chan interface{}),
+	}
+
+	if config.SpoolDirectory != "" {
+		out.spool, err = newSpool(config.SpoolDirectory, config.MaxSpoolBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go out.processor(ctx)
+
+	return out, nil
+}
+
+// "http://localhost:8086" => "http://localhost:8086/write?db=ruuvi&precision=ns"
+func makeWriteUrl(config ruuvinatortypes.InfluxOutputConfig) (string, error) {
+	writeUrl, err := url.Parse(config.Url)
+	if err != nil {
+		return "", err
+	}
+
+	writeUrl.Path = strings.TrimRight(writeUrl.Path, "/") + "/write"
+
+	query := url.Values{}
+	query.Set("db", config.Database)
+	query.Set("precision", "ns")
+	if config.RetentionPolicy != "" {
+		query.Set("rp", config.RetentionPolicy)
+	}
+	writeUrl.RawQuery = query.Encode()
+
+	return writeUrl.String(), nil
+}
@@ -0,0 +1,192 @@
+package influxoutput
+
+import (
+	"context"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToLineProtocol(t *testing.T) {
+	humidity := 35.5
+	pressure := uint32(98875)
+	battery := 3.157
+	txPower := 4
+	rssi := -44
+
+	lines := toLineProtocol([]ruuvinatortypes.ResolvedSensorObservation{
+		{
+			SensorName: "Living room, sofa",
+			SensorTags: map[string]string{"floor": "2", "building": "HQ", "owner": ""},
+			Observation: ruuvinatortypes.SensorObservation{
+				SensorAddr: "fb:72:36:09:90:15",
+				Time:       time.Unix(1552832537, 123456000),
+				Measurements: ruuvinatortypes.SensorMeasurements{
+					Temperature: 19.68,
+					Humidity:    &humidity,
+					Pressure:    &pressure,
+					Battery:     &battery,
+					Acceleration: &ruuvinatortypes.AccelerationData{
+						X: 49,
+						Y: -41,
+						Z: 1034,
+					},
+					TxPower: &txPower,
+				},
+				Advertisement: ruuvinatortypes.AdvertisementMetadata{
+					Rssi: &rssi,
+				},
+			},
+		},
+	})
+
+	assert.EqualString(t, string(lines), `ruuvi,building=HQ,floor=2,name=Living\ room\,\ sofa,sensor=fb:72:36:09:90:15 temperature=19.68,humidity=35.5,pressure=98875i,battery=3.157,acceleration_x=49i,acceleration_y=-41i,acceleration_z=1034i,rssi=-44i,tx_power=4i 1552832537123456000
+`)
+}
+
+func TestSpoolWhileServerUnreachable(t *testing.T) {
+	serverUp := false
+	written := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !serverUp {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+
+		assert.EqualString(t, r.URL.String(), "/write?db=ruuvi&precision=ns")
+
+		body, _ := ioutil.ReadAll(r.Body)
+		written = append(written, string(body))
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	spoolDir, err := ioutil.TempDir("", "influxoutput")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(spoolDir)
+
+	config := ruuvinatortypes.InfluxOutputConfig{
+		Url:            server.URL,
+		Database:       "ruuvi",
+		SpoolDirectory: spoolDir,
+	}
+
+	writeUrl, err := makeWriteUrl(config)
+	assert.True(t, err == nil)
+
+	spool, err := newSpool(spoolDir, 0)
+	assert.True(t, err == nil)
+
+	out := &output{
+		config:     config,
+		writeUrl:   writeUrl,
+		spool:      spool,
+		httpClient: server.Client(),
+	}
+
+	ctx := context.Background()
+
+	// simulate earlier failed write
+	assert.True(t, spool.Add([]byte("batch1\n")) == nil)
+
+	// spool can't be flushed, so this goes there too (to keep order)
+	out.writeOrSpool(ctx, []byte("batch2\n"))
+
+	spooled, err := spool.Files()
+	assert.True(t, err == nil)
+	assert.True(t, len(spooled) == 2)
+	assert.True(t, len(written) == 0)
+
+	serverUp = true
+
+	out.writeOrSpool(ctx, []byte("batch3\n"))
+
+	assert.EqualString(t, strings.Join(written, ""), "batch1\nbatch2\nbatch3\n")
+
+	spooled, err = spool.Files()
+	assert.True(t, err == nil)
+	assert.True(t, len(spooled) == 0)
+}
+
+func TestRejectedBatchesAreDropped(t *testing.T) {
+	written := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if strings.HasPrefix(string(body), "bad") {
+			http.Error(w, `{"error":"unable to parse 'bad'"}`, http.StatusBadRequest)
+			return
+		}
+
+		written = append(written, string(body))
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	spoolDir, err := ioutil.TempDir("", "influxoutput")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(spoolDir)
+
+	config := ruuvinatortypes.InfluxOutputConfig{
+		Url:            server.URL,
+		Database:       "ruuvi",
+		SpoolDirectory: spoolDir,
+	}
+
+	writeUrl, err := makeWriteUrl(config)
+	assert.True(t, err == nil)
+
+	spool, err := newSpool(spoolDir, 0)
+	assert.True(t, err == nil)
+
+	out := &output{
+		config:     config,
+		writeUrl:   writeUrl,
+		spool:      spool,
+		httpClient: server.Client(),
+	}
+
+	ctx := context.Background()
+
+	assert.True(t, spool.Add([]byte("bad1\n")) == nil)
+	assert.True(t, spool.Add([]byte("batch2\n")) == nil)
+
+	out.writeOrSpool(ctx, []byte("batch3\n"))
+	out.writeOrSpool(ctx, []byte("bad4\n"))
+
+	assert.EqualString(t, strings.Join(written, ""), "batch2\nbatch3\n")
+
+	spooled, err := spool.Files()
+	assert.True(t, err == nil)
+	assert.True(t, len(spooled) == 0)
+}
+
+func TestSpoolEvictsOldest(t *testing.T) {
+	spoolDir, err := ioutil.TempDir("", "influxoutput")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(spoolDir)
+
+	spool, err := newSpool(spoolDir, 10)
+	assert.True(t, err == nil)
+
+	assert.True(t, spool.Add([]byte("batch1\n")) == nil)
+	assert.True(t, spool.Add([]byte("batch2\n")) == nil)
+
+	spooled, err := spool.Files()
+	assert.True(t, err == nil)
+	assert.True(t, len(spooled) == 1)
+
+	content, err := ioutil.ReadFile(spooled[0])
+	assert.True(t, err == nil)
+	assert.EqualString(t, string(content), "batch2\n")
+}
@@ -0,0 +1,115 @@
+package influxoutput
+
+import (
+	"fmt"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// https://docs.influxdata.com/influxdb/v1.7/write_protocols/line_protocol_reference/
+
+const (
+	measurementName = "ruuvi"
+)
+
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// one line per observation, with tags "sensor" & "name" (same as Prometheus labels) and
+// sensor's tags
+func toLineProtocol(observations []ruuvinatortypes.ResolvedSensorObservation) []byte {
+	lines := strings.Builder{}
+
+	for _, observation := range observations {
+		measurements := observation.Observation.Measurements // shorthand
+
+		fields := []string{
+			floatField("temperature", measurements.Temperature),
+		}
+
+		// format 5 sensors can signal these as not available
+		if measurements.Humidity != nil {
+			fields = append(fields, floatField("humidity", *measurements.Humidity))
+		}
+
+		if measurements.Pressure != nil {
+			fields = append(fields, intField("pressure", int64(*measurements.Pressure)))
+		}
+
+		if measurements.Battery != nil {
+			fields = append(fields, floatField("battery", *measurements.Battery))
+		}
+
+		if acceleration := measurements.Acceleration; acceleration != nil {
+			fields = append(
+				fields,
+				intField("acceleration_x", int64(acceleration.X)),
+				intField("acceleration_y", int64(acceleration.Y)),
+				intField("acceleration_z", int64(acceleration.Z)))
+		}
+
+		if rssi := observation.Observation.Advertisement.Rssi; rssi != nil {
+			fields = append(fields, intField("rssi", int64(*rssi)))
+		}
+
+		// not available in older data formats
+		if measurements.TxPower != nil {
+			fields = append(fields, intField("tx_power", int64(*measurements.TxPower)))
+		}
+
+		if measurements.MovementCounter != nil {
+			fields = append(fields, intField("movement_counter", int64(*measurements.MovementCounter)))
+		}
+
+		if measurements.MeasurementSequenceNumber != nil {
+			fields = append(fields, intField("measurement_sequence_number", int64(*measurements.MeasurementSequenceNumber)))
+		}
+
+		tags := map[string]string{}
+		for key, value := range observation.SensorTags {
+			if value != "" { // not allowed by line protocol
+				tags[key] = value
+			}
+		}
+
+		// ours win
+		tags["name"] = observation.SensorName
+		tags["sensor"] = observation.Observation.SensorAddr
+
+		fmt.Fprintf(
+			&lines,
+			"%s,%s %s %d\n",
+			measurementName,
+			tagSet(tags),
+			strings.Join(fields, ","),
+			observation.Observation.Time.UnixNano())
+	}
+
+	return []byte(lines.String())
+}
+
+// tags should be sorted by key for best performance
+func tagSet(tags map[string]string) string {
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, tagEscaper.Replace(key)+"="+tagEscaper.Replace(tags[key]))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func floatField(key string, value float64) string {
+	return key + "=" + strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func intField(key string, value int64) string {
+	return key + "=" + strconv.FormatInt(value, 10) + "i"
+}
@@ -0,0 +1,93 @@
+package influxoutput
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// batches that couldn't be written are stored here (one file per batch) until the server
+// is reachable again. filenames sort in write order.
+type spool struct {
+	directory string
+	maxBytes  int64 // 0 = no limit
+	sequence  int
+}
+
+func newSpool(directory string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	return &spool{
+		directory: directory,
+		maxBytes:  maxBytes,
+	}, nil
+}
+
+func (s *spool) Add(batch []byte) error {
+	// sequence disambiguates batches spooled within the same nanosecond (coarse clocks)
+	s.sequence++
+
+	filename := filepath.Join(
+		s.directory,
+		fmt.Sprintf("%020d-%06d.lp", time.Now().UnixNano(), s.sequence%1000000))
+
+	if err := ioutil.WriteFile(filename, batch, 0644); err != nil {
+		return err
+	}
+
+	return s.evictOldestIfTooBig()
+}
+
+// oldest first
+func (s *spool) Files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.directory, "*.lp"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func (s *spool) evictOldestIfTooBig() error {
+	if s.maxBytes == 0 {
+		return nil
+	}
+
+	files, err := s.Files()
+	if err != nil {
+		return err
+	}
+
+	sizes := []int64{}
+	total := int64(0)
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		sizes = append(sizes, info.Size())
+		total += info.Size()
+	}
+
+	// never evict the newest one, even if it alone is bigger than the limit
+	for i := 0; total > s.maxBytes && i < len(files)-1; i++ {
+		log.Error(fmt.Sprintf("spool full; dropping %s", filepath.Base(files[i])))
+
+		if err := os.Remove(files[i]); err != nil {
+			return err
+		}
+
+		total -= sizes[i]
+	}
+
+	return nil
+}
@@ -0,0 +1,368 @@
+package mqttoutput
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/function61/gokit/logger"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logger.New("mqtt-output")
+
+const (
+	defaultClientId        = "ruuvinator"
+	defaultTopicPrefix     = "ruuvinator"
+	defaultDiscoveryPrefix = "homeassistant"
+	statusOnline           = "online"
+	statusOffline          = "offline"
+	publishTimeout         = 10 * time.Second
+)
+
+// so tests don't need a broker
+type publisher interface {
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+}
+
+// publishes each observation (as the same JSON as other outputs use) to
+// "<topic_prefix>/<sensor address without colons>". status ("online" / "offline" via last
+// will) is kept in "<topic_prefix>/status".
+type output struct {
+	config       ruuvinatortypes.MqttOutputConfig
+	publisher    publisher
+	observations chan ruuvinatortypes.ResolvedSensorObservation
+	reconnected  chan interface{}
+	stopped      chan interface{}
+	announced    map[string]bool // sensor addresses whose Home Assistant discovery config is published
+	publishMu    sync.Mutex      // WriteBatch() can be called concurrently with processor
+}
+
+func (o *output) GetObservationsChan() chan<- ruuvinatortypes.ResolvedSensorObservation {
+	return o.observations
+}
+
+func (o *output) Close() {
+	close(o.observations)
+
+	<-o.stopped
+}
+
+func (o *output) processor(ctx context.Context) {
+	log.Info("starting")
+	defer log.Info("stopped")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.reconnected:
+			// broker might have lost retained discovery configs (if it has no persistence)
+			o.publishMu.Lock()
+			o.announced = map[string]bool{}
+			o.publishMu.Unlock()
+		case observation, ok := <-o.observations:
+			if !ok {
+				return
+			}
+
+			if err := o.publishObservation(observation); err != nil {
+				log.Error(err.Error())
+			}
+		}
+	}
+}
+
+func (o *output) WriteBatch(ctx context.Context, observations []ruuvinatortypes.ResolvedSensorObservation) error {
+	for _, observation := range observations {
+		if err := o.publishObservation(observation); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *output) publishObservation(observation ruuvinatortypes.ResolvedSensorObservation) error {
+	o.publishMu.Lock()
+	defer o.publishMu.Unlock()
+
+	addr := observation.Observation.SensorAddr
+
+	if o.config.HomeAssistantDiscovery && !o.announced[addr] {
+		if err := o.publishDiscoveryConfigs(observation); err != nil {
+			return fmt.Errorf("publishDiscoveryConfigs: %s", err.Error())
+		}
+
+		o.announced[addr] = true
+	}
+
+	observationAsJson, err := json.Marshal(observation)
+	if err != nil {
+		return err
+	}
+
+	return o.publisher.Publish(
+		o.stateTopic(addr),
+		o.config.Qos,
+		o.config.Retain,
+		observationAsJson)
+}
+
+// https://www.home-assistant.io/docs/mqtt/discovery/
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueId          string          `json:"unique_id"`
+	StateTopic        string          `json:"state_topic"`
+	AvailabilityTopic string          `json:"availability_topic"`
+	ValueTemplate     string          `json:"value_template"`
+	UnitOfMeasurement string          `json:"unit_of_measurement"`
+	DeviceClass       string          `json:"device_class,omitempty"`
+	Device            discoveryDevice `json:"device"`
+}
+
+type discoverableMeasurement struct {
+	id            string
+	name          string
+	valueTemplate string
+	unit          string
+	deviceClass   string
+}
+
+var discoverableMeasurements = []discoverableMeasurement{
+	{"temperature", "temperature", "{{ value_json.observation.measurements.temperature }}", "°C", "temperature"},
+	{"humidity", "humidity", "{{ value_json.observation.measurements.humidity }}", "%", "humidity"},
+	{"pressure", "pressure", "{{ value_json.observation.measurements.pressure / 100 }}", "hPa", "pressure"},
+	{"battery", "battery", "{{ value_json.observation.measurements.battery }}", "V", ""},
+	{"rssi", "signal strength", "{{ value_json.observation.advertisement.rssi }}", "dBm", "signal_strength"},
+}
+
+func (o *output) publishDiscoveryConfigs(observation ruuvinatortypes.ResolvedSensorObservation) error {
+	addrId := addrWithoutColons(observation.Observation.SensorAddr)
+
+	device := discoveryDevice{
+		Identifiers:  []string{"ruuvinator_" + addrId},
+		Name:         observation.SensorName,
+		Manufacturer: "Ruuvi",
+		Model:        "RuuviTag",
+	}
+
+	for _, measurement := range discoverableMeasurements {
+		configAsJson, err := json.Marshal(discoveryConfig{
+			Name:              observation.SensorName + " " + measurement.name,
+			UniqueId:          "ruuvinator_" + addrId + "_" + measurement.id,
+			StateTopic:        o.stateTopic(observation.Observation.SensorAddr),
+			AvailabilityTopic: o.statusTopic(),
+			ValueTemplate:     measurement.valueTemplate,
+			UnitOfMeasurement: measurement.unit,
+			DeviceClass:       measurement.deviceClass,
+			Device:            device,
+		})
+		if err != nil {
+			return err
+		}
+
+		topic := fmt.Sprintf(
+			"%s/sensor/%s/%s_%s/config",
+			o.discoveryPrefix(),
+			o.discoveryNodeId(),
+			addrId,
+			measurement.id)
+
+		// retained, so Home Assistant finds these after its restart as well
+		if err := o.publisher.Publish(topic, o.config.Qos, true, configAsJson); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *output) stateTopic(addr string) string {
+	return o.topicPrefix() + "/" + addrWithoutColons(addr)
+}
+
+func (o *output) statusTopic() string {
+	return o.topicPrefix() + "/status"
+}
+
+func (o *output) topicPrefix() string {
+	if o.config.TopicPrefix == "" {
+		return defaultTopicPrefix
+	}
+
+	return o.config.TopicPrefix
+}
+
+func (o *output) clientId() string {
+	if o.config.ClientId == "" {
+		return defaultClientId
+	}
+
+	return o.config.ClientId
+}
+
+// Home Assistant allows only [a-zA-Z0-9_-] in node ids
+func (o *output) discoveryNodeId() string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, o.clientId())
+}
+
+func (o *output) discoveryPrefix() string {
+	if o.config.HomeAssistantDiscoveryPrefix == "" {
+		return defaultDiscoveryPrefix
+	}
+
+	return o.config.HomeAssistantDiscoveryPrefix
+}
+
+func New(ctx context.Context, config ruuvinatortypes.MqttOutputConfig) (*output, error) {
+	out := newOutput(config)
+
+	client, err := connect(config, out.clientId(), out.statusTopic(), out.reconnected)
+	if err != nil {
+		return nil, err
+	}
+
+	out.publisher = &pahoPublisher{client}
+
+	go func() {
+		defer close(out.stopped)
+
+		out.processor(ctx)
+
+		// graceful disconnect doesn't trigger last will, so publish offline status ourselves
+		if err := out.publisher.Publish(out.statusTopic(), config.Qos, true, []byte(statusOffline)); err != nil {
+			log.Error(err.Error())
+		}
+
+		client.Disconnect(1000)
+	}()
+
+	return out, nil
+}
+
+func newOutput(config ruuvinatortypes.MqttOutputConfig) *output {
+	return &output{
+		config:       config,
+		observations: make(chan ruuvinatortypes.ResolvedSensorObservation, 100),
+		reconnected:  make(chan interface{}, 1),
+		stopped:      make(chan interface{}),
+		announced:    map[string]bool{},
+	}
+}
+
+func connect(
+	config ruuvinatortypes.MqttOutputConfig,
+	clientId string,
+	statusTopic string,
+	reconnected chan interface{},
+) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.BrokerUrl).
+		SetClientID(clientId).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetWill(statusTopic, statusOffline, config.Qos, true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			// runs on each reconnect as well
+			token := client.Publish(statusTopic, config.Qos, true, statusOnline)
+			if token.WaitTimeout(publishTimeout) && token.Error() != nil {
+				log.Error(fmt.Sprintf("publish status: %s", token.Error().Error()))
+			}
+
+			select {
+			case reconnected <- nil:
+			default: // processor has not yet handled previous one
+			}
+		})
+
+	if config.TlsCaFile != "" || config.TlsCertFile != "" || config.TlsInsecureSkipVerify {
+		tlsConfig, err := makeTlsConfig(config)
+		if err != nil {
+			return nil, err
+		}
+
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	client := mqtt.NewClient(opts)
+
+	token := client.Connect()
+	if !token.WaitTimeout(publishTimeout) {
+		return nil, errors.New("connect: timed out")
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("connect: %s", err.Error())
+	}
+
+	return client, nil
+}
+
+func makeTlsConfig(config ruuvinatortypes.MqttOutputConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.TlsInsecureSkipVerify,
+	}
+
+	if config.TlsCaFile != "" {
+		caPem, err := ioutil.ReadFile(config.TlsCaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found from %s", config.TlsCaFile)
+		}
+	}
+
+	if config.TlsCertFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.TlsCertFile, config.TlsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
+}
+
+type pahoPublisher struct {
+	client mqtt.Client
+}
+
+func (p *pahoPublisher) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	token := p.client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("publish %s: timed out", topic)
+	}
+
+	return token.Error()
+}
+
+// "aa:bb:cc:dd:ee:ff" => "aabbccddeeff" (colons are awkward in topics & ids)
+func addrWithoutColons(addr string) string {
+	return strings.Replace(addr, ":", "", -1)
+}
@@ -0,0 +1,104 @@
+package mqttoutput
+
+import (
+	"encoding/json"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"testing"
+)
+
+type message struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  string
+}
+
+type testPublisher struct {
+	published []message
+}
+
+func (t *testPublisher) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	t.published = append(t.published, message{topic, qos, retained, string(payload)})
+	return nil
+}
+
+func TestPublishObservation(t *testing.T) {
+	pub := &testPublisher{}
+
+	out := newOutput(ruuvinatortypes.MqttOutputConfig{
+		Qos:    1,
+		Retain: true,
+	})
+	out.publisher = pub
+
+	observation := ruuvinatortypes.ResolvedSensorObservation{
+		SensorName: "Bedroom",
+		Observation: ruuvinatortypes.SensorObservation{
+			SensorAddr: "fb:72:36:09:90:15",
+		},
+	}
+
+	assert.True(t, out.publishObservation(observation) == nil)
+
+	assert.True(t, len(pub.published) == 1)
+	assert.EqualString(t, pub.published[0].topic, "ruuvinator/fb7236099015")
+	assert.True(t, pub.published[0].qos == 1)
+	assert.True(t, pub.published[0].retained)
+
+	fromJson := ruuvinatortypes.ResolvedSensorObservation{}
+	assert.True(t, json.Unmarshal([]byte(pub.published[0].payload), &fromJson) == nil)
+	assert.EqualString(t, fromJson.SensorName, "Bedroom")
+}
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	pub := &testPublisher{}
+
+	out := newOutput(ruuvinatortypes.MqttOutputConfig{
+		TopicPrefix:            "home/ruuvi",
+		HomeAssistantDiscovery: true,
+	})
+	out.publisher = pub
+
+	observation := ruuvinatortypes.ResolvedSensorObservation{
+		SensorName: "Bedroom",
+		Observation: ruuvinatortypes.SensorObservation{
+			SensorAddr: "fb:72:36:09:90:15",
+		},
+	}
+
+	assert.True(t, out.publishObservation(observation) == nil)
+
+	// discovery configs for each measurement + the observation itself
+	assert.True(t, len(pub.published) == len(discoverableMeasurements)+1)
+
+	temperatureConfig := pub.published[0]
+	assert.EqualString(t, temperatureConfig.topic, "homeassistant/sensor/ruuvinator/fb7236099015_temperature/config")
+	assert.True(t, temperatureConfig.retained)
+	assert.EqualString(t, temperatureConfig.payload, `{"name":"Bedroom temperature","unique_id":"ruuvinator_fb7236099015_temperature","state_topic":"home/ruuvi/fb7236099015","availability_topic":"home/ruuvi/status","value_template":"{{ value_json.observation.measurements.temperature }}","unit_of_measurement":"°C","device_class":"temperature","device":{"identifiers":["ruuvinator_fb7236099015"],"name":"Bedroom","manufacturer":"Ruuvi","model":"RuuviTag"}}`)
+
+	assert.EqualString(t, pub.published[len(pub.published)-1].topic, "home/ruuvi/fb7236099015")
+
+	// discovery configs are published only once
+	assert.True(t, out.publishObservation(observation) == nil)
+	assert.True(t, len(pub.published) == len(discoverableMeasurements)+2)
+}
+
+func TestDiscoveryTopicUsesClientId(t *testing.T) {
+	pub := &testPublisher{}
+
+	out := newOutput(ruuvinatortypes.MqttOutputConfig{
+		ClientId:               "ruuvinator.garage",
+		HomeAssistantDiscovery: true,
+	})
+	out.publisher = pub
+
+	assert.True(t, out.publishObservation(ruuvinatortypes.ResolvedSensorObservation{
+		SensorName: "Garage",
+		Observation: ruuvinatortypes.SensorObservation{
+			SensorAddr: "fb:72:36:09:90:15",
+		},
+	}) == nil)
+
+	assert.EqualString(t, pub.published[0].topic, "homeassistant/sensor/ruuvinator_garage/fb7236099015_temperature/config")
+}
@@ -0,0 +1,33 @@
+package observationbatch
+
+import (
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+)
+
+// reads firstItem + whatever else is immediately available in ch (up to limit), so outputs
+// can send observations in batches without waiting for more to arrive.
+// this could really benefit from generics
+func ReadMoreUnblocking(
+	limit int,
+	firstItem ruuvinatortypes.ResolvedSensorObservation,
+	ch <-chan ruuvinatortypes.ResolvedSensorObservation,
+) []ruuvinatortypes.ResolvedSensorObservation {
+	items := []ruuvinatortypes.ResolvedSensorObservation{firstItem}
+
+	// -1 becase we already have firstItem
+	for i := 0; i < limit-1; i++ {
+		// peek into the channel
+		select {
+		case item, ok := <-ch:
+			if !ok { // closed
+				return items
+			}
+
+			items = append(items, item)
+		default:
+			i = limit // exit from peek loop
+		}
+	}
+
+	return items
+}
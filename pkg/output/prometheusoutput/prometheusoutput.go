@@ -0,0 +1,118 @@
+package prometheusoutput
+
+import (
+	"context"
+	"github.com/function61/gokit/logger"
+	"github.com/function61/ruuvinator/pkg/ruuvimetrics"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"time"
+)
+
+var log = logger.New("prometheus-output")
+
+const (
+	staleCheckInterval = 10 * time.Second
+)
+
+// serves the same "ruuvi_*" gauges as metricsserver does, but straight from the client so
+// no SQS is needed
+type output struct {
+	observations chan ruuvinatortypes.ResolvedSensorObservation
+	stopped      chan interface{}
+}
+
+func (o *output) GetObservationsChan() chan<- ruuvinatortypes.ResolvedSensorObservation {
+	return o.observations
+}
+
+func (o *output) Close() {
+	close(o.observations)
+
+	<-o.stopped
+}
+
+func (o *output) processor(ctx context.Context, metrics *ruuvimetrics.Metrics, server *http.Server) {
+	log.Info("starting")
+	defer log.Info("stopped")
+	defer close(o.stopped)
+
+	defer func() {
+		ctxShutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := server.Shutdown(ctxShutdown); err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
+	staleCheck := time.NewTicker(staleCheckInterval)
+	defer staleCheck.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-staleCheck.C:
+			metrics.ExpireStale(now)
+		case observation, ok := <-o.observations:
+			if !ok {
+				return
+			}
+
+			metrics.Observe(observation)
+		}
+	}
+}
+
+func New(ctx context.Context, config ruuvinatortypes.PrometheusOutputConfig) (*output, error) {
+	if err := ruuvimetrics.ValidateTagLabels(config.TagLabels); err != nil {
+		return nil, err
+	}
+
+	// listen here so we can report errors like port being already in use
+	listener, err := net.Listen("tcp", config.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// own registry so we only serve Ruuvi metrics and not whatever else registers globally
+	registry := prometheus.NewRegistry()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{
+		Handler: mux,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Error(err.Error())
+		}
+	}()
+
+	out := &output{
+		observations: make(chan ruuvinatortypes.ResolvedSensorObservation, 16),
+		stopped:      make(chan interface{}),
+	}
+
+	staleTimeout := ruuvimetrics.DefaultStaleTimeout
+	if config.StaleTimeoutSeconds != 0 {
+		staleTimeout = time.Duration(config.StaleTimeoutSeconds) * time.Second
+	}
+
+	metrics := ruuvimetrics.New(registry, ruuvimetrics.Options{
+		StaleTimeout:             staleTimeout,
+		UseObservationTimestamps: config.UseObservationTimestamps,
+		MovementThreshold:        config.MovementThreshold,
+		TagLabels:                config.TagLabels,
+	})
+
+	go out.processor(ctx, metrics, server)
+
+	return out, nil
+}
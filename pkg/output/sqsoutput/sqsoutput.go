@@ -4,10 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/function61/gokit/logger"
+	"github.com/function61/gokit/retry"
+	"github.com/function61/ruuvinator/pkg/output/observationbatch"
+	"github.com/function61/ruuvinator/pkg/queuetransport"
 	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
-	"github.com/function61/ruuvinator/pkg/sqsfacade"
 	"time"
 )
 
@@ -19,30 +20,44 @@ const (
 	maxObservationsPerOneSqsMessage = 100
 )
 
+// sends observations in batches to a message queue (SQS originally, hence the name) for
+// metricsserver to consume
 type output struct {
-	config       ruuvinatortypes.SqsOutputConfig
+	transport    queuetransport.Transport
 	observations chan ruuvinatortypes.ResolvedSensorObservation
+	stopped      chan interface{}
 }
 
 func (o *output) GetObservationsChan() chan<- ruuvinatortypes.ResolvedSensorObservation {
 	return o.observations
 }
 
+func (o *output) Close() {
+	close(o.observations)
+
+	<-o.stopped
+}
+
 func (o *output) processor(ctx context.Context) {
 	log.Info("starting")
 	defer log.Info("stopped")
-
-	sqsClient := sqsfacade.New(
-		o.config.QueueUrl,
-		o.config.AwsAccessKeyId,
-		o.config.AwsAccessKeySecret)
+	defer close(o.stopped)
+	defer func() {
+		if err := o.transport.Close(); err != nil {
+			log.Error(err.Error())
+		}
+	}()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return // stop loop
-		case firstItem := <-o.observations:
-			observations := readMoreUnblocking(maxObservationsPerOneSqsMessage, firstItem, o.observations)
+		case firstItem, ok := <-o.observations:
+			if !ok { // closed => everything was sent
+				return
+			}
+
+			observations := observationbatch.ReadMoreUnblocking(maxObservationsPerOneSqsMessage, firstItem, o.observations)
 
 			if len(observations) >= maxObservationsPerOneSqsMessage {
 				log.Info(fmt.Sprintf(
@@ -50,26 +65,11 @@ func (o *output) processor(ctx context.Context) {
 					len(observations)))
 			}
 
-			observationsAsJson, err := json.Marshal(observations)
-			if err != nil {
-				panic(err)
-			}
-
-			// send just one message in a batch. previously we sent each observation as own
-			// msg, but that proved out to be (relatively) expensive
-			messages := []*sqs.SendMessageBatchRequestEntry{
-				sqsfacade.ToSimpleQueueEntry(string(observationsAsJson), 0),
-			}
-
 			// try to limit sending to one msg/2 seconds to cheap out on AWS bills
 			nextPossibleQueueSubmit := time.Now().Add(2 * time.Second)
 
-			failed := func(err error) {
-				log.Error(fmt.Sprintf("Send: %s", err.Error()))
-			}
-
-			if err := sqsClient.Send(ctx, messages, 10*time.Second, failed); err != nil {
-				failed(err)
+			if err := o.WriteBatch(ctx, observations); err != nil {
+				log.Error(fmt.Sprintf("dropping %d observations: %s", len(observations), err.Error()))
 			}
 
 			time.Sleep(time.Until(nextPossibleQueueSubmit))
@@ -77,37 +77,38 @@ func (o *output) processor(ctx context.Context) {
 	}
 }
 
-func New(ctx context.Context, config ruuvinatortypes.SqsOutputConfig) *output {
+// sends observations as one message. previously we sent each observation as own msg, but
+// that proved out to be (relatively) expensive
+func (o *output) WriteBatch(ctx context.Context, observations []ruuvinatortypes.ResolvedSensorObservation) error {
+	observationsAsJson, err := json.Marshal(observations)
+	if err != nil {
+		return ruuvinatortypes.NewPermanentError(err)
+	}
+
+	ctxRetry, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	return retry.Retry(
+		ctxRetry,
+		func(ctx context.Context) error {
+			return o.transport.Send(ctx, string(observationsAsJson))
+		},
+		retry.DefaultBackoff(),
+		func(err error) {
+			log.Error(fmt.Sprintf("Send: %s", err.Error()))
+		})
+}
+
+func New(ctx context.Context, transport queuetransport.Transport) *output {
 	out := &output{
-		config: config,
+		transport: transport,
 		observations: make(
 			chan ruuvinatortypes.ResolvedSensorObservation,
 			maxObservationsPerOneSqsMessage*2),
+		stopped: make(chan interface{}),
 	}
 
 	go out.processor(ctx)
 
 	return out
 }
-
-// this could really benefit from generics
-func readMoreUnblocking(
-	limit int,
-	firstItem ruuvinatortypes.ResolvedSensorObservation,
-	ch <-chan ruuvinatortypes.ResolvedSensorObservation,
-) []ruuvinatortypes.ResolvedSensorObservation {
-	items := []ruuvinatortypes.ResolvedSensorObservation{firstItem}
-
-	// -1 becase we already have firstItem
-	for i := 0; i < limit-1; i++ {
-		// peek into the channel
-		select {
-		case item := <-ch:
-			items = append(items, item)
-		default:
-			i = limit // exit from peek loop
-		}
-	}
-
-	return items
-}
@@ -0,0 +1,50 @@
+package sqsoutput
+
+import (
+	"context"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/queuetransport"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"testing"
+)
+
+func TestSendsObservationsAsOneMessage(t *testing.T) {
+	transport := &testTransport{}
+
+	out := New(context.Background(), transport)
+
+	out.GetObservationsChan() <- ruuvinatortypes.ResolvedSensorObservation{SensorName: "Sauna"}
+
+	out.Close()
+
+	assert.True(t, len(transport.sent) == 1)
+	assert.EqualString(t, transport.sent[0][0:29], `[{"sensor_name":"Sauna","obse`)
+	assert.True(t, transport.closed)
+}
+
+type testTransport struct {
+	sent   []string
+	closed bool
+}
+
+func (t *testTransport) Send(_ context.Context, body string) error {
+	t.sent = append(t.sent, body)
+	return nil
+}
+
+func (t *testTransport) Receive(_ context.Context) ([]queuetransport.Message, error) {
+	panic("not used")
+}
+
+func (t *testTransport) Ack(_ context.Context, _ []queuetransport.Message) error {
+	panic("not used")
+}
+
+func (t *testTransport) Reject(_ context.Context, _ []queuetransport.Message) error {
+	panic("not used")
+}
+
+func (t *testTransport) Close() error {
+	t.closed = true
+	return nil
+}
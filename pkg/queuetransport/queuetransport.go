@@ -0,0 +1,47 @@
+package queuetransport
+
+import (
+	"context"
+	"errors"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+)
+
+// message queue between the client (sqsoutput) and metricsserver
+type Transport interface {
+	// one attempt. caller is responsible for retrying
+	Send(ctx context.Context, body string) error
+	// waits for a while (long polling) for messages. can return zero messages
+	Receive(ctx context.Context) ([]Message, error)
+	// removes messages from the queue. un-acked messages will be received again later
+	Ack(ctx context.Context, messages []Message) error
+	// for messages that can't be processed. SQS leaves them un-acked, so they're moved to the
+	// dead-letter queue after too many receives (if queue has redrive policy). Redis moves
+	// them to a dead-letter stream.
+	Reject(ctx context.Context, messages []Message) error
+	Close() error
+}
+
+type Message struct {
+	Id        string // unique within queue
+	Body      string
+	ackHandle interface{} // transport-specific
+}
+
+func New(config ruuvinatortypes.QueueConfig) (Transport, error) {
+	switch config.Transport {
+	case "", "sqs":
+		if config.Sqs == nil {
+			return nil, errors.New("transport sqs needs sqs config")
+		}
+
+		return NewSqs(*config.Sqs)
+	case "redis":
+		if config.Redis == nil {
+			return nil, errors.New("transport redis needs redis config")
+		}
+
+		return NewRedis(*config.Redis)
+	default:
+		return nil, errors.New("unknown transport: " + config.Transport)
+	}
+}
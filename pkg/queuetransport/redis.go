@@ -0,0 +1,186 @@
+package queuetransport
+
+import (
+	"context"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"github.com/go-redis/redis"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	redisDefaultStream = "ruuvinator"
+	redisDefaultGroup  = "metricsserver"
+	redisBodyField     = "body"
+	redisIdField       = "id" // in dead-letter stream: message's id in the original stream
+	redisReceiveWait   = 10 * time.Second
+)
+
+// uses a Redis stream. receiving is done as a member of a consumer group, so messages
+// are kept in the group's pending list until acked
+type redisTransport struct {
+	client   *redis.Client
+	config   ruuvinatortypes.RedisQueueConfig
+	stream   string
+	group    string
+	consumer string
+	// rejected messages are moved here, so they don't stay in the pending list forever
+	deadLetterStream string
+	// after start, first receive our pending (received but not acked before a crash)
+	// messages. each of them only once, so a failing one doesn't block the rest
+	pendingCursor  string
+	pendingDrained bool
+	groupCreated   bool
+}
+
+func NewRedis(config ruuvinatortypes.RedisQueueConfig) (Transport, error) {
+	consumer := config.Consumer
+	if consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+
+		consumer = hostname
+	}
+
+	stream := stringOrDefault(config.Stream, redisDefaultStream)
+
+	return &redisTransport{
+		client: redis.NewClient(&redis.Options{
+			Addr:     config.Addr,
+			Password: config.Password,
+			DB:       config.Db,
+			// must be longer than blocking receive
+			ReadTimeout: redisReceiveWait + 5*time.Second,
+		}),
+		config:           config,
+		stream:           stream,
+		group:            stringOrDefault(config.Group, redisDefaultGroup),
+		consumer:         consumer,
+		deadLetterStream: stringOrDefault(config.DeadLetterStream, stream+":dead"),
+		pendingCursor:    "0",
+	}, nil
+}
+
+func (r *redisTransport) Send(ctx context.Context, body string) error {
+	return r.client.WithContext(ctx).XAdd(&redis.XAddArgs{
+		Stream:       r.stream,
+		MaxLenApprox: r.config.MaxLen,
+		Values: map[string]interface{}{
+			redisBodyField: body,
+		},
+	}).Err()
+}
+
+func (r *redisTransport) Receive(ctx context.Context) ([]Message, error) {
+	if err := r.createGroupIfNeeded(ctx); err != nil {
+		return nil, err
+	}
+
+	if !r.pendingDrained {
+		// our pending ones after the cursor. -1 = don't block
+		pending, err := r.read(ctx, r.pendingCursor, -1)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(pending) > 0 {
+			r.pendingCursor = pending[len(pending)-1].Id
+			return pending, nil
+		}
+
+		r.pendingDrained = true
+	}
+
+	return r.read(ctx, ">", redisReceiveWait) // ">" = never delivered to anyone
+}
+
+func (r *redisTransport) read(ctx context.Context, id string, block time.Duration) ([]Message, error) {
+	streams, err := r.client.WithContext(ctx).XReadGroup(&redis.XReadGroupArgs{
+		Group:    r.group,
+		Consumer: r.consumer,
+		Streams:  []string{r.stream, id},
+		Count:    10,
+		Block:    block,
+	}).Result()
+	if err != nil && err != redis.Nil { // redis.Nil = timeout
+		return nil, err
+	}
+
+	messages := []Message{}
+
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			body, _ := msg.Values[redisBodyField].(string)
+
+			messages = append(messages, Message{
+				Id:        msg.ID,
+				Body:      body,
+				ackHandle: msg.ID,
+			})
+		}
+	}
+
+	return messages, nil
+}
+
+func (r *redisTransport) Ack(ctx context.Context, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := []string{}
+	for _, message := range messages {
+		ids = append(ids, message.ackHandle.(string))
+	}
+
+	return r.client.WithContext(ctx).XAck(r.stream, r.group, ids...).Err()
+}
+
+// copies to dead-letter stream first, so a crash in between can only cause a duplicate there
+func (r *redisTransport) Reject(ctx context.Context, messages []Message) error {
+	for _, message := range messages {
+		err := r.client.WithContext(ctx).XAdd(&redis.XAddArgs{
+			Stream: r.deadLetterStream,
+			Values: map[string]interface{}{
+				redisIdField:   message.Id,
+				redisBodyField: message.Body,
+			},
+		}).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.Ack(ctx, messages)
+}
+
+func (r *redisTransport) Close() error {
+	return r.client.Close()
+}
+
+func (r *redisTransport) createGroupIfNeeded(ctx context.Context) error {
+	if r.groupCreated {
+		return nil
+	}
+
+	// "0" = group gets also messages sent before group existed
+	err := r.client.WithContext(ctx).XGroupCreateMkStream(r.stream, r.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") { // BUSYGROUP = already exists
+		return err
+	}
+
+	r.groupCreated = true
+
+	return nil
+}
+
+func stringOrDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+
+	return value
+}
@@ -0,0 +1,267 @@
+package queuetransport
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedis(t *testing.T) {
+	fake := startFakeRedis(t)
+	defer fake.listener.Close()
+
+	ctx := context.Background()
+
+	newTransport := func() Transport {
+		transport, err := NewRedis(ruuvinatortypes.RedisQueueConfig{
+			Addr:     fake.listener.Addr().String(),
+			Consumer: "test",
+		})
+		assert.True(t, err == nil)
+
+		return transport
+	}
+
+	sender := newTransport()
+	defer sender.Close()
+
+	assert.True(t, sender.Send(ctx, "msg1") == nil)
+	assert.True(t, sender.Send(ctx, "msg2") == nil)
+
+	receiver := newTransport()
+
+	received, err := receiver.Receive(ctx)
+	assert.True(t, err == nil)
+	assert.EqualString(t, bodies(received), "msg1,msg2")
+
+	assert.True(t, receiver.Ack(ctx, received[0:1]) == nil)
+
+	// simulate crash before acking msg2
+	assert.True(t, receiver.Close() == nil)
+
+	assert.True(t, sender.Send(ctx, "msg3") == nil)
+
+	receiver = newTransport()
+	defer receiver.Close()
+
+	// pending one is received again after restart
+	received, err = receiver.Receive(ctx)
+	assert.True(t, err == nil)
+	assert.EqualString(t, bodies(received), "msg2")
+
+	pending := received
+
+	// not acking msg2 (processing failed) must not block the rest
+	received, err = receiver.Receive(ctx)
+	assert.True(t, err == nil)
+	assert.EqualString(t, bodies(received), "msg3")
+	assert.True(t, receiver.Ack(ctx, received) == nil)
+
+	assert.True(t, receiver.Reject(ctx, pending) == nil)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	dead := fake.streams["ruuvinator:dead"]
+	assert.True(t, len(dead) == 1)
+	assert.EqualString(t, dead[0].fields["id"], "2-0")
+	assert.EqualString(t, dead[0].fields["body"], "msg2")
+
+	// rejected one doesn't stay pending
+	assert.True(t, len(fake.pending) == 0)
+}
+
+func bodies(messages []Message) string {
+	items := []string{}
+	for _, message := range messages {
+		items = append(items, message.Body)
+	}
+
+	return strings.Join(items, ",")
+}
+
+// just enough of a Redis stream with one consumer group to test against
+type fakeRedis struct {
+	listener  net.Listener
+	mu        sync.Mutex
+	groups    map[string]bool
+	streams   map[string][]fakeRedisEntry
+	delivered int             // index of next never-delivered entry (of the group's stream)
+	pending   map[string]bool // delivered but not acked
+}
+
+type fakeRedisEntry struct {
+	id     string
+	fields map[string]string
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.True(t, err == nil)
+
+	fake := &fakeRedis{
+		listener: listener,
+		groups:   map[string]bool{},
+		streams:  map[string][]fakeRedisEntry{},
+		pending:  map[string]bool{},
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go fake.serve(conn)
+		}
+	}()
+
+	return fake
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		args, err := readRespCommand(reader)
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		response := f.handle(args)
+		f.mu.Unlock()
+
+		if _, err := conn.Write([]byte(response)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) handle(args []string) string {
+	switch strings.ToLower(args[0]) {
+	case "xgroup": // XGROUP CREATE stream group start MKSTREAM
+		if f.groups[args[3]] {
+			return "-BUSYGROUP Consumer Group name already exists\r\n"
+		}
+
+		f.groups[args[3]] = true
+		return "+OK\r\n"
+	case "xadd": // XADD stream [MAXLEN ~ n] * field value [field value ...]
+		stream := args[1]
+
+		fields := map[string]string{}
+		for i := indexOf(args, "*") + 1; i+1 < len(args); i += 2 {
+			fields[args[i]] = args[i+1]
+		}
+
+		id := fmt.Sprintf("%d-0", len(f.streams[stream])+1)
+		f.streams[stream] = append(f.streams[stream], fakeRedisEntry{id, fields})
+		return bulkString(id)
+	case "xreadgroup": // XREADGROUP GROUP g c [COUNT n] [BLOCK ms] STREAMS stream id
+		readId := args[len(args)-1]
+		stream := args[len(args)-2]
+
+		entries := []fakeRedisEntry{}
+
+		if readId == ">" {
+			entries = f.streams[stream][f.delivered:]
+			f.delivered = len(f.streams[stream])
+
+			for _, entry := range entries {
+				f.pending[entry.id] = true
+			}
+		} else {
+			for _, entry := range f.streams[stream] {
+				if f.pending[entry.id] && idSequence(entry.id) > idSequence(readId) {
+					entries = append(entries, entry)
+				}
+			}
+		}
+
+		if len(entries) == 0 && readId == ">" {
+			return "*-1\r\n" // timeout
+		}
+
+		response := "*1\r\n*2\r\n" + bulkString(stream) + fmt.Sprintf("*%d\r\n", len(entries))
+		for _, entry := range entries {
+			response += "*2\r\n" + bulkString(entry.id) + "*2\r\n" + bulkString("body") + bulkString(entry.fields["body"])
+		}
+
+		return response
+	case "xack": // XACK stream group id...
+		for _, id := range args[3:] {
+			delete(f.pending, id)
+		}
+
+		return fmt.Sprintf(":%d\r\n", len(args)-3)
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func readRespCommand(reader *bufio.Reader) ([]string, error) {
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{}
+
+	for i := 0; i < count; i++ {
+		lengthLine, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		length, err := strconv.Atoi(strings.TrimSpace(lengthLine[1:]))
+		if err != nil {
+			return nil, err
+		}
+
+		arg := make([]byte, length+2) // + "\r\n"
+		if _, err := io.ReadFull(reader, arg); err != nil {
+			return nil, err
+		}
+
+		args = append(args, string(arg[:length]))
+	}
+
+	return args, nil
+}
+
+func indexOf(items []string, item string) int {
+	for idx, candidate := range items {
+		if candidate == item {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// "3-0" => 3
+func idSequence(id string) int {
+	sequence, _ := strconv.Atoi(strings.Split(id, "-")[0])
+	return sequence
+}
+
+func bulkString(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
@@ -0,0 +1,71 @@
+package queuetransport
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"github.com/function61/ruuvinator/pkg/sqsfacade"
+)
+
+type sqsTransport struct {
+	sqsClient *sqsfacade.SQS
+}
+
+func NewSqs(config ruuvinatortypes.SqsOutputConfig) (Transport, error) {
+	sqsClient, err := sqsfacade.New(sqsfacade.Config{
+		QueueUrl:        config.QueueUrl,
+		Region:          config.Region,
+		Endpoint:        config.Endpoint,
+		AccessKeyId:     config.AwsAccessKeyId,
+		AccessKeySecret: config.AwsAccessKeySecret,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqsTransport{sqsClient}, nil
+}
+
+func (s *sqsTransport) Send(ctx context.Context, body string) error {
+	return s.sqsClient.SendOnce(ctx, []*sqs.SendMessageBatchRequestEntry{
+		sqsfacade.ToSimpleQueueEntry(body, 0),
+	})
+}
+
+func (s *sqsTransport) Receive(ctx context.Context) ([]Message, error) {
+	received, err := s.sqsClient.Receive(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []Message{}
+
+	for _, msg := range received.Messages {
+		messages = append(messages, Message{
+			Id:        *msg.MessageId,
+			Body:      *msg.Body,
+			ackHandle: msg,
+		})
+	}
+
+	return messages, nil
+}
+
+func (s *sqsTransport) Ack(ctx context.Context, messages []Message) error {
+	received := &sqs.ReceiveMessageOutput{}
+
+	for _, message := range messages {
+		received.Messages = append(received.Messages, message.ackHandle.(*sqs.Message))
+	}
+
+	return s.sqsClient.AckReceived(received)
+}
+
+// redrive policy takes care of these
+func (s *sqsTransport) Reject(ctx context.Context, messages []Message) error {
+	return nil
+}
+
+func (s *sqsTransport) Close() error {
+	return nil
+}
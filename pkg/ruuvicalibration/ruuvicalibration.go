@@ -0,0 +1,54 @@
+package ruuvicalibration
+
+import (
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"math"
+)
+
+func Apply(
+	calibration ruuvinatortypes.SensorCalibration,
+	measurements ruuvinatortypes.SensorMeasurements,
+) ruuvinatortypes.SensorMeasurements {
+	if calibration.KeepRaw {
+		measurements.Raw = &ruuvinatortypes.RawMeasurements{
+			Temperature: measurements.Temperature,
+			Humidity:    measurements.Humidity,
+			Pressure:    measurements.Pressure,
+			Battery:     measurements.Battery,
+		}
+	}
+
+	measurements.Temperature = apply(calibration.Temperature, measurements.Temperature)
+
+	// ones the sensor didn't report stay missing
+	if measurements.Humidity != nil {
+		// calibration must not make it physically impossible
+		humidity := math.Max(0, math.Min(100, apply(calibration.Humidity, *measurements.Humidity)))
+		measurements.Humidity = &humidity
+	}
+
+	if measurements.Pressure != nil {
+		pressure := uint32(math.Max(0, math.Round(apply(calibration.Pressure, float64(*measurements.Pressure)))))
+		measurements.Pressure = &pressure
+	}
+
+	if measurements.Battery != nil {
+		battery := apply(calibration.Battery, *measurements.Battery)
+		measurements.Battery = &battery
+	}
+
+	return measurements
+}
+
+func apply(calibration *ruuvinatortypes.LinearCalibration, value float64) float64 {
+	if calibration == nil {
+		return value
+	}
+
+	gain := 1.0
+	if calibration.Gain != nil {
+		gain = *calibration.Gain
+	}
+
+	return value*gain + calibration.Offset
+}
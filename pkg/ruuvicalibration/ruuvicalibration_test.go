@@ -0,0 +1,67 @@
+package ruuvicalibration
+
+import (
+	"encoding/json"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	whitelist := ruuvinatortypes.SensorWhitelist{}
+
+	assert.True(t, json.Unmarshal([]byte(`{
+		"aa:bb:cc:dd:ee:ff": "Bedroom",
+		"ff:ee:dd:cc:bb:aa": {
+			"name": "Greenhouse",
+			"calibration": {
+				"temperature": {"offset": -0.3},
+				"humidity": {"offset": 4, "gain": 1.02},
+				"pressure": {"offset": 120},
+				"keep_raw": true
+			}
+		}
+	}`), &whitelist) == nil)
+
+	assert.EqualString(t, whitelist["aa:bb:cc:dd:ee:ff"].Name, "Bedroom")
+	assert.True(t, whitelist["aa:bb:cc:dd:ee:ff"].Calibration == nil)
+
+	greenhouse := whitelist["ff:ee:dd:cc:bb:aa"]
+
+	humidity := 97.0
+	pressure := uint32(100330)
+	battery := 2.9
+
+	calibrated := Apply(*greenhouse.Calibration, ruuvinatortypes.SensorMeasurements{
+		Temperature: 22.5,
+		Humidity:    &humidity,
+		Pressure:    &pressure,
+		Battery:     &battery,
+	})
+
+	asJson, _ := json.Marshal(calibrated)
+
+	assert.EqualString(t, string(asJson), `{"data_format":0,"temperature":22.2,"humidity":100,"pressure":100450,"battery":2.9,"raw":{"temperature":22.5,"humidity":97,"pressure":100330,"battery":2.9}}`)
+}
+
+func TestMissingValuesStayMissing(t *testing.T) {
+	gain := 1.02
+
+	calibrated := Apply(ruuvinatortypes.SensorCalibration{
+		Humidity: &ruuvinatortypes.LinearCalibration{Offset: 4, Gain: &gain},
+		Pressure: &ruuvinatortypes.LinearCalibration{Offset: 120},
+		KeepRaw:  true,
+	}, ruuvinatortypes.SensorMeasurements{Temperature: 22.5})
+
+	asJson, _ := json.Marshal(calibrated)
+
+	assert.EqualString(t, string(asJson), `{"data_format":0,"temperature":22.5,"raw":{"temperature":22.5}}`)
+}
+
+func TestUnknownCalibrationFieldIsError(t *testing.T) {
+	whitelist := ruuvinatortypes.SensorWhitelist{}
+
+	err := json.Unmarshal([]byte(`{"ff:ee:dd:cc:bb:aa": {"name": "Greenhouse", "calibrations": {}}}`), &whitelist)
+
+	assert.EqualString(t, err.Error(), `json: unknown field "calibrations"`)
+}
@@ -0,0 +1,51 @@
+package ruuviderived
+
+import (
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"math"
+)
+
+// Magnus formula constants over water (Sonntag 1990), good for -45 .. 60 °C
+const (
+	magnusA = 611.2 // Pa
+	magnusB = 17.62
+	magnusC = 243.12 // °C
+
+	waterVaporGasConstant = 461.5 // J/(kg*K)
+)
+
+// returns nil if the sensor didn't report humidity
+func Environment(measurements ruuvinatortypes.SensorMeasurements) *ruuvinatortypes.DerivedMeasurements {
+	if measurements.Humidity == nil || *measurements.Humidity <= 0 {
+		return nil // dew point would be -Inf
+	}
+
+	temperature := measurements.Temperature
+	relativeHumidity := math.Min(*measurements.Humidity, 100) / 100
+
+	saturation := SaturationVaporPressure(temperature)
+	actual := relativeHumidity * saturation
+
+	return &ruuvinatortypes.DerivedMeasurements{
+		DewPoint:                 DewPoint(temperature, *measurements.Humidity),
+		AbsoluteHumidity:         actual / (waterVaporGasConstant * celsiusToKelvin(temperature)) * 1000,
+		EquilibriumVaporPressure: saturation,
+		VaporPressureDeficit:     saturation - actual,
+	}
+}
+
+// a.k.a. equilibrium vapor pressure, in Pa
+func SaturationVaporPressure(temperature float64) float64 {
+	return magnusA * math.Exp(magnusB*temperature/(magnusC+temperature))
+}
+
+// temperature in °C, relative humidity in %. result in °C
+func DewPoint(temperature float64, relativeHumidity float64) float64 {
+	gamma := math.Log(relativeHumidity/100) + magnusB*temperature/(magnusC+temperature)
+
+	return magnusC * gamma / (magnusB - gamma)
+}
+
+func celsiusToKelvin(celsius float64) float64 {
+	return celsius + 273.15
+}
@@ -0,0 +1,28 @@
+package ruuviderived
+
+import (
+	"fmt"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"testing"
+)
+
+func TestEnvironment(t *testing.T) {
+	humidity := 60.0
+
+	derived := Environment(ruuvinatortypes.SensorMeasurements{
+		Temperature: 25,
+		Humidity:    &humidity,
+	})
+
+	assert.EqualString(t, fmt.Sprintf("%.1f", derived.DewPoint), "16.7")
+	assert.EqualString(t, fmt.Sprintf("%.1f", derived.AbsoluteHumidity), "13.8")
+	assert.EqualString(t, fmt.Sprintf("%.0f", derived.EquilibriumVaporPressure), "3160")
+	assert.EqualString(t, fmt.Sprintf("%.0f", derived.VaporPressureDeficit), "1264")
+
+	// below freezing
+	assert.EqualString(t, fmt.Sprintf("%.1f", DewPoint(-10, 80)), "-12.8")
+
+	// humidity not reported
+	assert.True(t, Environment(ruuvinatortypes.SensorMeasurements{Temperature: 25}) == nil)
+}
@@ -0,0 +1,43 @@
+package ruuviderived
+
+import (
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"math"
+)
+
+// acceleration from Ruuvi is in milli-g
+func AccelerationG(acc ruuvinatortypes.AccelerationData) (float64, float64, float64) {
+	return float64(acc.X) / 1000, float64(acc.Y) / 1000, float64(acc.Z) / 1000
+}
+
+// total acceleration in g. ~1 when sensor is stationary (gravity)
+func AccelerationMagnitude(acc ruuvinatortypes.AccelerationData) float64 {
+	x, y, z := AccelerationG(acc)
+
+	return math.Sqrt(x*x + y*y + z*z)
+}
+
+// pitch (angle of X axis above horizontal) and roll (rotation around X axis) in degrees,
+// assuming the only acceleration is gravity. both are 0 when sensor lies flat (Z pointing up)
+func Tilt(acc ruuvinatortypes.AccelerationData) (float64, float64) {
+	x, y, z := AccelerationG(acc)
+
+	pitch := math.Atan2(x, math.Sqrt(y*y+z*z))
+	roll := math.Atan2(y, z)
+
+	return radiansToDegrees(pitch), radiansToDegrees(roll)
+}
+
+// length of the change in acceleration vector between two observations, in g
+func AccelerationChange(previous ruuvinatortypes.AccelerationData, current ruuvinatortypes.AccelerationData) float64 {
+	px, py, pz := AccelerationG(previous)
+	cx, cy, cz := AccelerationG(current)
+
+	dx, dy, dz := cx-px, cy-py, cz-pz
+
+	return math.Sqrt(dx*dx + dy*dy + dz*dz)
+}
+
+func radiansToDegrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
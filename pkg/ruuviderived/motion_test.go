@@ -0,0 +1,35 @@
+package ruuviderived
+
+import (
+	"fmt"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"testing"
+)
+
+func TestAccelerationMagnitude(t *testing.T) {
+	magnitude := AccelerationMagnitude(ruuvinatortypes.AccelerationData{X: 49, Y: -41, Z: 1034})
+
+	assert.EqualString(t, fmt.Sprintf("%.3f", magnitude), "1.036")
+}
+
+func TestTilt(t *testing.T) {
+	tilt := func(x, y, z int16) string {
+		pitch, roll := Tilt(ruuvinatortypes.AccelerationData{X: x, Y: y, Z: z})
+
+		return fmt.Sprintf("%.1f %.1f", pitch, roll)
+	}
+
+	assert.EqualString(t, tilt(0, 0, 1000), "0.0 0.0")    // flat
+	assert.EqualString(t, tilt(0, 1000, 0), "0.0 90.0")   // on its side
+	assert.EqualString(t, tilt(1000, 0, 0), "90.0 0.0")   // standing on its edge
+	assert.EqualString(t, tilt(0, 0, -1000), "0.0 180.0") // upside down
+}
+
+func TestAccelerationChange(t *testing.T) {
+	change := AccelerationChange(
+		ruuvinatortypes.AccelerationData{X: 0, Y: 0, Z: 1000},
+		ruuvinatortypes.AccelerationData{X: 300, Y: 0, Z: 1400})
+
+	assert.EqualString(t, fmt.Sprintf("%.3f", change), "0.500")
+}
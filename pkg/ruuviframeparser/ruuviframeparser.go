@@ -12,8 +12,15 @@ import (
 )
 
 const (
-	btAddrLen            = 6
-	format3PayloadOffset = 19
+	eventTypeOffset          = 5
+	addressTypeOffset        = 6
+	addressOffset            = 7
+	advertisingDataLenOffset = 13
+	advertisingDataOffset    = 14
+	btAddrLen                = 6
+	manufacturerDataOffset   = 19
+	minManufacturerDataFrame = 36  // shortest frame (format 3) we're interested in
+	rssiNotAvailable         = 127 // per Bluetooth spec
 )
 
 var (
@@ -33,9 +40,39 @@ type SensorFormat3 struct {
 	BatteryVoltageMv    uint16
 }
 
+type SensorFormat5 struct {
+	ManufacturerID            uint16
+	DataFormat                uint8
+	Temperature               int16
+	Humidity                  uint16
+	Pressure                  uint16
+	AccelerationX             int16
+	AccelerationY             int16
+	AccelerationZ             int16
+	PowerInfo                 uint16 // 11 bits battery voltage, 5 bits TX power
+	MovementCounter           uint8
+	MeasurementSequenceNumber uint16
+	Mac                       [btAddrLen]byte
+}
+
 // https://github.com/ruuvi/ruuvi-sensor-protocols
 
-var ruuviFormat3Signature = []byte{0x99, 0x04, 0x03}
+var (
+	ruuviFormat3Signature = []byte{0x99, 0x04, 0x03}
+	ruuviFormat5Signature = []byte{0x99, 0x04, 0x05}
+)
+
+// format 5 signals "not available" for a field by setting it to its max (or min, for signed) value
+const (
+	format5TemperatureInvalid               = -32768
+	format5HumidityInvalid                  = 65535
+	format5PressureInvalid                  = 65535
+	format5AccelerationInvalid              = -32768
+	format5BatteryInvalid                   = 2047
+	format5TxPowerInvalid                   = 31
+	format5MovementCounterInvalid           = 255
+	format5MeasurementSequenceNumberInvalid = 65535
+)
 
 func parseTemperature(t uint8, f uint8) float64 {
 	mask := uint8(1 << 7)
@@ -48,7 +85,7 @@ func parseTemperature(t uint8, f uint8) float64 {
 }
 
 // thanks https://github.com/Turee/goruuvitag
-func parseSensorFormat3(data []byte, addr string) (*ruuvinatortypes.SensorObservation, error) {
+func parseSensorFormat3(data []byte, addr string, received time.Time) (*ruuvinatortypes.SensorObservation, error) {
 	reader := bytes.NewReader(data)
 	result := SensorFormat3{}
 	err := binary.Read(reader, binary.BigEndian, &result)
@@ -56,15 +93,20 @@ func parseSensorFormat3(data []byte, addr string) (*ruuvinatortypes.SensorObserv
 		return nil, err
 	}
 
+	humidity := float64(result.Humidity) / 2.0
+	pressure := uint32(result.Pressure) + 50000
+	battery := float64(result.BatteryVoltageMv) / 1000.0
+
 	return &ruuvinatortypes.SensorObservation{
 		SensorAddr: addr,
-		Time:       time.Now(),
+		Time:       received,
 		Measurements: ruuvinatortypes.SensorMeasurements{
+			DataFormat:  result.DataFormat,
 			Temperature: parseTemperature(result.Temperature, result.TemperatureFraction),
-			Humidity:    float64(result.Humidity) / 2.0,
-			Pressure:    uint32(result.Pressure) + 50000,
-			Battery:     float64(result.BatteryVoltageMv) / 1000.0,
-			Acceleration: ruuvinatortypes.AccelerationData{
+			Humidity:    &humidity,
+			Pressure:    &pressure,
+			Battery:     &battery,
+			Acceleration: &ruuvinatortypes.AccelerationData{
 				X: result.AccelerationX,
 				Y: result.AccelerationY,
 				Z: result.AccelerationZ,
@@ -73,6 +115,79 @@ func parseSensorFormat3(data []byte, addr string) (*ruuvinatortypes.SensorObserv
 	}, nil
 }
 
+// https://github.com/ruuvi/ruuvi-sensor-protocols/blob/master/dataformat_05.md
+func parseSensorFormat5(data []byte, addr string, received time.Time) (*ruuvinatortypes.SensorObservation, error) {
+	reader := bytes.NewReader(data)
+	result := SensorFormat5{}
+	err := binary.Read(reader, binary.BigEndian, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	// unlike the rest, temperature is not optional: everything downstream (metrics, derived
+	// measurements, line protocol) expects it, and a sensor without it is broken anyway
+	if result.Temperature == format5TemperatureInvalid {
+		return nil, errors.New("format 5: temperature not available")
+	}
+
+	batteryMv := result.PowerInfo >> 5
+	txPower := result.PowerInfo & 0x1f
+
+	measurements := ruuvinatortypes.SensorMeasurements{
+		DataFormat:  result.DataFormat,
+		Temperature: float64(result.Temperature) / 200.0, // 0.005 degree steps
+	}
+
+	if result.Humidity != format5HumidityInvalid {
+		humidity := float64(result.Humidity) / 400.0 // 0.0025 % steps
+		measurements.Humidity = &humidity
+	}
+
+	if result.Pressure != format5PressureInvalid {
+		pressure := uint32(result.Pressure) + 50000
+		measurements.Pressure = &pressure
+	}
+
+	// tilt etc. need all axes, so one missing makes the whole vector missing
+	if result.AccelerationX != format5AccelerationInvalid &&
+		result.AccelerationY != format5AccelerationInvalid &&
+		result.AccelerationZ != format5AccelerationInvalid {
+		measurements.Acceleration = &ruuvinatortypes.AccelerationData{
+			X: result.AccelerationX,
+			Y: result.AccelerationY,
+			Z: result.AccelerationZ,
+		}
+	}
+
+	if batteryMv != format5BatteryInvalid {
+		battery := float64(uint32(batteryMv)+1600) / 1000.0
+		measurements.Battery = &battery
+	}
+
+	if txPower != format5TxPowerInvalid {
+		txPowerDbm := int(txPower)*2 - 40
+		measurements.TxPower = &txPowerDbm
+	}
+
+	if result.MovementCounter != format5MovementCounterInvalid {
+		measurements.MovementCounter = &result.MovementCounter
+	}
+
+	if result.MeasurementSequenceNumber != format5MeasurementSequenceNumberInvalid {
+		measurements.MeasurementSequenceNumber = &result.MeasurementSequenceNumber
+	}
+
+	// unlike the advertisement address, this one is in normal order
+	mac := utils.SplitStringIntoGroupsOfTwo(hex.EncodeToString(result.Mac[:]), ":")
+	measurements.Mac = &mac
+
+	return &ruuvinatortypes.SensorObservation{
+		SensorAddr:   addr,
+		Time:         received,
+		Measurements: measurements,
+	}, nil
+}
+
 // good reference implementation:
 // https://github.com/ttu/ruuvitag-sensor/blob/master/ruuvitag_sensor/ruuvi.py
 func Parse(frame hciframereceiver.Frame) (*ruuvinatortypes.SensorObservation, error) {
@@ -80,7 +195,7 @@ func Parse(frame hciframereceiver.Frame) (*ruuvinatortypes.SensorObservation, er
 		return nil, nil // not an error per se
 	}
 
-	if len(frame.Data) < 36 {
+	if len(frame.Data) < minManufacturerDataFrame {
 		return nil, errUnknownFormat
 	}
 
@@ -89,23 +204,64 @@ func Parse(frame hciframereceiver.Frame) (*ruuvinatortypes.SensorObservation, er
 		return nil, errUnknownFormat
 	}
 
-	if !bytes.Equal(ruuviFormat3Signature, frame.Data[format3PayloadOffset:format3PayloadOffset+len(ruuviFormat3Signature)]) {
+	manufacturerData := frame.Data[manufacturerDataOffset:]
+
+	var parseSensorFormat func([]byte, string, time.Time) (*ruuvinatortypes.SensorObservation, error)
+
+	switch {
+	case bytes.HasPrefix(manufacturerData, ruuviFormat3Signature):
+		parseSensorFormat = parseSensorFormat3
+	case bytes.HasPrefix(manufacturerData, ruuviFormat5Signature):
+		parseSensorFormat = parseSensorFormat5
+	default:
 		return nil, errUnknownFormat
 	}
 
-	btAddrBytes := unfuckBluetoothAddress(frame.Data[7 : 7+btAddrLen])
+	btAddrBytes := unfuckBluetoothAddress(frame.Data[addressOffset : addressOffset+btAddrLen])
 	btAddrString := utils.SplitStringIntoGroupsOfTwo(hex.EncodeToString(btAddrBytes), ":")
 
-	sensorDataParsed, err := parseSensorFormat3(
-		frame.Data[format3PayloadOffset:],
-		btAddrString)
+	// hcidump and captures give a timestamp, but frames from elsewhere might not
+	received := frame.Time
+	if received.IsZero() {
+		received = time.Now()
+	}
+
+	sensorDataParsed, err := parseSensorFormat(manufacturerData, btAddrString, received)
 	if err != nil {
 		return nil, err
 	}
 
+	advertisement, err := parseAdvertisementMetadata(frame.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	sensorDataParsed.Advertisement = *advertisement
+
 	return sensorDataParsed, nil
 }
 
+// frame is HCI LE Advertising Report event with one report:
+// [0] packet type, [1] event code, [2] params length, [3] subevent, [4] number of reports,
+// [5] event type, [6] address type, [7:13] address, [13] data length, [14:] data, RSSI
+func parseAdvertisementMetadata(frame []byte) (*ruuvinatortypes.AdvertisementMetadata, error) {
+	rssiOffset := advertisingDataOffset + int(frame[advertisingDataLenOffset])
+	if rssiOffset >= len(frame) {
+		return nil, errors.New("advertising report: RSSI beyond end of frame")
+	}
+
+	advertisement := &ruuvinatortypes.AdvertisementMetadata{
+		AddressType: frame[addressTypeOffset],
+		EventType:   frame[eventTypeOffset],
+	}
+
+	if rssi := int(int8(frame[rssiOffset])); rssi != rssiNotAvailable {
+		advertisement.Rssi = &rssi
+	}
+
+	return advertisement, nil
+}
+
 // for some braindead reason (security by obscurity?) the Bluetooth address is in reverse order
 func unfuckBluetoothAddress(addr []byte) []byte {
 	return []byte{addr[5], addr[4], addr[3], addr[2], addr[1], addr[0]}
@@ -1,12 +1,14 @@
 package ruuviframeparser
 
 import (
+	"encoding/hex"
 	"github.com/function61/gokit/assert"
 	"github.com/function61/ruuvinator/pkg/hciframereceiver"
 	"github.com/function61/ruuvinator/pkg/ruuvinatortestdata"
 	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseAnyRuuviFormat(t *testing.T) {
@@ -25,22 +27,86 @@ func TestParseAnyRuuviFormat(t *testing.T) {
 	obs := observations[0]
 
 	assert.EqualString(t, obs.SensorAddr, "fb:72:36:09:90:15")
+	assert.True(t, obs.Measurements.DataFormat == 3)
+	assert.True(t, obs.Measurements.TxPower == nil)
 	assert.True(t, obs.Measurements.Temperature == 19.68)
-	assert.True(t, obs.Measurements.Humidity == 35.5)
-	assert.True(t, obs.Measurements.Pressure == 98875)
-	assert.True(t, obs.Measurements.Battery == 3.157)
+	assert.True(t, *obs.Measurements.Humidity == 35.5)
+	assert.True(t, *obs.Measurements.Pressure == 98875)
+	assert.True(t, *obs.Measurements.Battery == 3.157)
 	assert.True(t, obs.Measurements.Acceleration.X == 49)
 	assert.True(t, obs.Measurements.Acceleration.Y == -41)
 	assert.True(t, obs.Measurements.Acceleration.Z == 1034)
+	assert.True(t, *obs.Advertisement.Rssi == -44)
+	assert.True(t, obs.Advertisement.AddressType == 1)
+	assert.True(t, obs.Advertisement.EventType == 3)
 
 	obs = observations[1]
 
 	assert.EqualString(t, obs.SensorAddr, "e5:fa:12:7e:ef:65")
 	assert.True(t, obs.Measurements.Temperature == 1.13)
-	assert.True(t, obs.Measurements.Humidity == 87)
-	assert.True(t, obs.Measurements.Pressure == 99754)
-	assert.True(t, obs.Measurements.Battery == 2.845)
+	assert.True(t, *obs.Measurements.Humidity == 87)
+	assert.True(t, *obs.Measurements.Pressure == 99754)
+	assert.True(t, *obs.Measurements.Battery == 2.845)
 	assert.True(t, obs.Measurements.Acceleration.X == 542)
 	assert.True(t, obs.Measurements.Acceleration.Y == 421)
 	assert.True(t, obs.Measurements.Acceleration.Z == -726)
+	assert.True(t, *obs.Advertisement.Rssi == -89)
+}
+
+func TestParseFormat5(t *testing.T) {
+	observations := []*ruuvinatortypes.SensorObservation{}
+
+	err := hciframereceiver.ParseStream(strings.NewReader(ruuvinatortestdata.DemoStreamFormat5), func(frame hciframereceiver.Frame) {
+		observation, _ := Parse(frame)
+		if observation != nil {
+			observations = append(observations, observation)
+		}
+	})
+
+	assert.True(t, err == nil)
+	assert.True(t, len(observations) == 1)
+
+	obs := observations[0]
+
+	assert.EqualString(t, obs.SensorAddr, "cb:b8:33:4c:88:4f")
+	assert.True(t, obs.Measurements.DataFormat == 5)
+	assert.True(t, obs.Measurements.Temperature == 24.3)
+	assert.True(t, *obs.Measurements.Humidity == 53.49)
+	assert.True(t, *obs.Measurements.Pressure == 100044)
+	assert.True(t, *obs.Measurements.Battery == 2.977)
+	assert.True(t, obs.Measurements.Acceleration.X == 4)
+	assert.True(t, obs.Measurements.Acceleration.Y == -4)
+	assert.True(t, obs.Measurements.Acceleration.Z == 1036)
+	assert.True(t, *obs.Measurements.TxPower == 4)
+	assert.True(t, *obs.Measurements.MovementCounter == 66)
+	assert.True(t, *obs.Measurements.MeasurementSequenceNumber == 205)
+	assert.EqualString(t, *obs.Measurements.Mac, "cb:b8:33:4c:88:4f")
+	assert.True(t, *obs.Advertisement.Rssi == -62)
+}
+
+func TestParseFormat5NotAvailable(t *testing.T) {
+	// temperature 0.005 °C, everything else signalled as not available
+	data, _ := hex.DecodeString("99040500" + "01" + "ffff" + "ffff" + "8000" + "0004" + "040c" + "ffff" + "ff" + "ffff" + "cbb8334c884f")
+
+	obs, err := parseSensorFormat5(data, "cb:b8:33:4c:88:4f", time.Now())
+
+	assert.True(t, err == nil)
+	assert.True(t, obs.Measurements.Temperature == 0.005)
+	assert.True(t, obs.Measurements.Humidity == nil)
+	assert.True(t, obs.Measurements.Pressure == nil)
+	assert.True(t, obs.Measurements.Acceleration == nil)
+	assert.True(t, obs.Measurements.Battery == nil)
+	assert.True(t, obs.Measurements.TxPower == nil)
+	assert.True(t, obs.Measurements.MovementCounter == nil)
+	assert.True(t, obs.Measurements.MeasurementSequenceNumber == nil)
+}
+
+func TestParseFormat5TemperatureNotAvailable(t *testing.T) {
+	data, _ := hex.DecodeString("99040580" + "00" + "ffff" + "ffff" + "8000" + "8000" + "8000" + "ffff" + "ff" + "ffff" + "cbb8334c884f")
+
+	obs, err := parseSensorFormat5(data, "cb:b8:33:4c:88:4f", time.Now())
+
+	// unlike other measurements, missing temperature drops the whole observation
+	assert.True(t, obs == nil)
+	assert.EqualString(t, err.Error(), "format 5: temperature not available")
 }
@@ -0,0 +1,447 @@
+package ruuvimetrics
+
+import (
+	"fmt"
+	"github.com/function61/ruuvinator/pkg/ruuviderived"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultStaleTimeout = 5 * time.Minute
+	// change in acceleration (g) between consecutive observations that counts as movement
+	DefaultMovementThreshold = 0.1
+)
+
+// the "ruuvi_*" gauges, shared by metricsserver and the client's Prometheus output
+type Metrics struct {
+	lastSeen                  *prometheus.GaugeVec
+	up                        *prometheus.GaugeVec
+	temperature               *prometheus.GaugeVec
+	humidity                  *prometheus.GaugeVec
+	pressure                  *prometheus.GaugeVec
+	battery                   *prometheus.GaugeVec
+	accelerationSum           *prometheus.GaugeVec // deprecated: meaningless physically. use the per-axis ones
+	accelerationX             *prometheus.GaugeVec
+	accelerationY             *prometheus.GaugeVec
+	accelerationZ             *prometheus.GaugeVec
+	accelerationMagnitude     *prometheus.GaugeVec
+	tiltPitch                 *prometheus.GaugeVec
+	tiltRoll                  *prometheus.GaugeVec
+	movementsDetected         *prometheus.CounterVec
+	dewPoint                  *prometheus.GaugeVec
+	absoluteHumidity          *prometheus.GaugeVec
+	equilibriumVaporPressure  *prometheus.GaugeVec
+	vaporPressureDeficit      *prometheus.GaugeVec
+	txPower                   *prometheus.GaugeVec
+	movementCounter           *prometheus.GaugeVec
+	measurementSequenceNumber *prometheus.GaugeVec
+	rssi                      *prometheus.GaugeVec
+	deliveryLatency           prometheus.Histogram
+	staleTimeout              time.Duration // 0 = never stale
+	movementThreshold         float64
+	tagLabels                 []string
+	now                       func() time.Time // for tests
+	sensorsMu                 sync.Mutex
+	sensors                   map[sensorKey]*sensorState
+}
+
+type Options struct {
+	StaleTimeout time.Duration // 0 = sensors are never considered stale
+	// export measurements with the time they were observed at instead of scrape time, so
+	// delayed deliveries (queue backlog etc.) show up at the right time
+	UseObservationTimestamps bool
+	MovementThreshold        float64 // g. 0 = DefaultMovementThreshold
+	// sensor tags exported as extra labels. use ValidateTagLabels() first
+	TagLabels []string
+}
+
+var labelNameRe = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+func ValidateTagLabels(tagLabels []string) error {
+	seen := map[string]bool{}
+
+	for _, tagLabel := range tagLabels {
+		if tagLabel == "sensor" || tagLabel == "name" {
+			return fmt.Errorf("tag label %s: reserved", tagLabel)
+		}
+
+		if seen[tagLabel] {
+			return fmt.Errorf("tag label %s: duplicate", tagLabel)
+		}
+		seen[tagLabel] = true
+
+		if !labelNameRe.MatchString(tagLabel) {
+			return fmt.Errorf("tag label %s: not a valid Prometheus label name", tagLabel)
+		}
+	}
+
+	return nil
+}
+
+type sensorKey struct {
+	addr string
+	name string
+}
+
+type sensorState struct {
+	lastSeen             time.Time
+	stale                bool
+	labels               prometheus.Labels                   // latest ones, as tags can change
+	previousMeasurements *ruuvinatortypes.SensorMeasurements // for movement detection
+}
+
+func (m *Metrics) Observe(observation ruuvinatortypes.ResolvedSensorObservation) {
+	sensorLabels := prometheus.Labels{
+		"sensor": observation.Observation.SensorAddr,
+		"name":   observation.SensorName,
+	}
+
+	for _, tagLabel := range m.tagLabels {
+		sensorLabels[tagLabel] = observation.SensorTags[tagLabel]
+	}
+
+	measurements := observation.Observation.Measurements // shorthand
+
+	if !observation.Observation.Time.IsZero() {
+		m.deliveryLatency.Observe(m.now().Sub(observation.Observation.Time).Seconds())
+	}
+
+	// we're called concurrently (ingest endpoint and queue). without this, an older
+	// observation that passed the check below could overwrite a newer one's values
+	m.sensorsMu.Lock()
+	defer m.sensorsMu.Unlock()
+
+	if newest := m.markSeen(observation, sensorLabels); !newest {
+		return // older observation (out of order delivery) must not overwrite newer values
+	}
+
+	m.temperature.With(sensorLabels).Set(measurements.Temperature)
+
+	// format 5 sensors can signal these as not available
+	if measurements.Humidity != nil {
+		m.humidity.With(sensorLabels).Set(*measurements.Humidity)
+	}
+
+	if measurements.Battery != nil {
+		m.battery.With(sensorLabels).Set(*measurements.Battery)
+	}
+
+	if measurements.Pressure != nil {
+		m.pressure.With(sensorLabels).Set(float64(*measurements.Pressure))
+	}
+
+	if acceleration := measurements.Acceleration; acceleration != nil {
+		m.accelerationSum.With(sensorLabels).Set(float64(acceleration.X + acceleration.Y + acceleration.Z))
+
+		accelerationX, accelerationY, accelerationZ := ruuviderived.AccelerationG(*acceleration)
+		m.accelerationX.With(sensorLabels).Set(accelerationX)
+		m.accelerationY.With(sensorLabels).Set(accelerationY)
+		m.accelerationZ.With(sensorLabels).Set(accelerationZ)
+		m.accelerationMagnitude.With(sensorLabels).Set(ruuviderived.AccelerationMagnitude(*acceleration))
+
+		pitch, roll := ruuviderived.Tilt(*acceleration)
+		m.tiltPitch.With(sensorLabels).Set(pitch)
+		m.tiltRoll.With(sensorLabels).Set(roll)
+	}
+
+	if m.movementDetected(observation) {
+		m.movementsDetected.With(sensorLabels).Inc()
+	}
+
+	if derived := ruuviderived.Environment(measurements); derived != nil {
+		m.dewPoint.With(sensorLabels).Set(derived.DewPoint)
+		m.absoluteHumidity.With(sensorLabels).Set(derived.AbsoluteHumidity)
+		m.equilibriumVaporPressure.With(sensorLabels).Set(derived.EquilibriumVaporPressure)
+		m.vaporPressureDeficit.With(sensorLabels).Set(derived.VaporPressureDeficit)
+	}
+
+	if rssi := observation.Observation.Advertisement.Rssi; rssi != nil {
+		m.rssi.With(sensorLabels).Set(float64(*rssi))
+	}
+
+	// not available in older data formats
+	if measurements.TxPower != nil {
+		m.txPower.With(sensorLabels).Set(float64(*measurements.TxPower))
+	}
+
+	if measurements.MovementCounter != nil {
+		m.movementCounter.With(sensorLabels).Set(float64(*measurements.MovementCounter))
+	}
+
+	if measurements.MeasurementSequenceNumber != nil {
+		m.measurementSequenceNumber.With(sensorLabels).Set(float64(*measurements.MeasurementSequenceNumber))
+	}
+}
+
+// sensors not seen for longer than staleTimeout are marked down and their measurement series
+// are dropped, so dashboards show a gap instead of a flat line
+func (m *Metrics) ExpireStale(now time.Time) {
+	if m.staleTimeout == 0 {
+		return
+	}
+
+	m.sensorsMu.Lock()
+	defer m.sensorsMu.Unlock()
+
+	for _, state := range m.sensors {
+		if state.stale || now.Sub(state.lastSeen) <= m.staleTimeout {
+			continue
+		}
+
+		state.stale = true
+
+		// last seen stays, so you can see when it went silent
+		m.up.With(state.labels).Set(0)
+
+		for _, gauge := range m.measurementGauges() {
+			gauge.Delete(state.labels)
+		}
+	}
+}
+
+// returns false if we have seen a newer observation from this sensor already.
+// call with sensorsMu held.
+func (m *Metrics) markSeen(observation ruuvinatortypes.ResolvedSensorObservation, sensorLabels prometheus.Labels) bool {
+	seen := observation.Observation.Time
+	if seen.IsZero() {
+		seen = m.now()
+	}
+
+	key := sensorKey{observation.Observation.SensorAddr, observation.SensorName}
+
+	state, found := m.sensors[key]
+	if !found {
+		state = &sensorState{}
+		m.sensors[key] = state
+	}
+
+	// observations can arrive out of order (queue redelivery etc.)
+	if seen.Before(state.lastSeen) {
+		return false
+	}
+
+	if state.labels != nil && !sameLabels(state.labels, sensorLabels) {
+		// tags changed. without this, the old series would live on with stale values
+		m.lastSeen.Delete(state.labels)
+		m.up.Delete(state.labels)
+		m.movementsDetected.Delete(state.labels)
+
+		for _, gauge := range m.measurementGauges() {
+			gauge.Delete(state.labels)
+		}
+	}
+
+	state.labels = sensorLabels
+	state.lastSeen = seen
+	m.lastSeen.With(sensorLabels).Set(float64(seen.UnixNano()) / float64(time.Second))
+
+	state.stale = false
+	m.up.With(sensorLabels).Set(1)
+
+	return true
+}
+
+// compares to previous observation of the same sensor. format 5 sensors also detect
+// movement themselves (movement counter). call with sensorsMu held.
+func (m *Metrics) movementDetected(observation ruuvinatortypes.ResolvedSensorObservation) bool {
+	key := sensorKey{observation.Observation.SensorAddr, observation.SensorName}
+
+	state := m.sensors[key] // exists, because markSeen() was called
+
+	previous := state.previousMeasurements
+	current := observation.Observation.Measurements
+	state.previousMeasurements = &current
+
+	if previous == nil {
+		return false
+	}
+
+	if previous.MovementCounter != nil && current.MovementCounter != nil &&
+		*previous.MovementCounter != *current.MovementCounter {
+		return true
+	}
+
+	if previous.Acceleration == nil || current.Acceleration == nil {
+		return false
+	}
+
+	return ruuviderived.AccelerationChange(*previous.Acceleration, *current.Acceleration) >= m.movementThreshold
+}
+
+func (m *Metrics) lastSeenBySensor() map[sensorKey]time.Time {
+	m.sensorsMu.Lock()
+	defer m.sensorsMu.Unlock()
+
+	lastSeen := map[sensorKey]time.Time{}
+	for key, state := range m.sensors {
+		lastSeen[key] = state.lastSeen
+	}
+
+	return lastSeen
+}
+
+func sameLabels(a prometheus.Labels, b prometheus.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for key, value := range a {
+		if b[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *Metrics) measurementGauges() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		m.temperature,
+		m.humidity,
+		m.pressure,
+		m.battery,
+		m.accelerationSum,
+		m.accelerationX,
+		m.accelerationY,
+		m.accelerationZ,
+		m.accelerationMagnitude,
+		m.tiltPitch,
+		m.tiltRoll,
+		m.dewPoint,
+		m.absoluteHumidity,
+		m.equilibriumVaporPressure,
+		m.vaporPressureDeficit,
+		m.txPower,
+		m.movementCounter,
+		m.measurementSequenceNumber,
+		m.rssi,
+	}
+}
+
+func New(registerer prometheus.Registerer, opts Options) *Metrics {
+	labels := append([]string{"sensor", "name"}, opts.TagLabels...)
+
+	newGauge := func(name string, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: name,
+				Help: help,
+			},
+			labels)
+	}
+
+	m := &Metrics{
+		lastSeen:              newGauge("ruuvi_last_seen_timestamp_seconds", "Ruuvi: when sensor was last seen (Unix time)"),
+		up:                    newGauge("ruuvi_up", "Ruuvi: 1 if sensor was seen within stale timeout, else 0"),
+		temperature:           newGauge("ruuvi_temperature", "Ruuvi: temperature"),
+		humidity:              newGauge("ruuvi_humidity", "Ruuvi: humidity"),
+		pressure:              newGauge("ruuvi_pressure", "Ruuvi: pressure"),
+		battery:               newGauge("ruuvi_battery", "Ruuvi: battery"),
+		accelerationSum:       newGauge("ruuvi_acceleration_sum", "Ruuvi: acceleration x + y + z"),
+		accelerationX:         newGauge("ruuvi_acceleration_x_g", "Ruuvi: acceleration, X axis (g)"),
+		accelerationY:         newGauge("ruuvi_acceleration_y_g", "Ruuvi: acceleration, Y axis (g)"),
+		accelerationZ:         newGauge("ruuvi_acceleration_z_g", "Ruuvi: acceleration, Z axis (g)"),
+		accelerationMagnitude: newGauge("ruuvi_acceleration_magnitude_g", "Ruuvi: total acceleration (g)"),
+		tiltPitch:             newGauge("ruuvi_tilt_pitch_degrees", "Ruuvi: angle of X axis above horizontal"),
+		tiltRoll:              newGauge("ruuvi_tilt_roll_degrees", "Ruuvi: rotation around X axis"),
+		movementsDetected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ruuvi_movements_detected_total",
+			Help: "Ruuvi: movements detected from consecutive observations",
+		}, labels),
+		dewPoint:                 newGauge("ruuvi_dew_point_celsius", "Ruuvi: dew point (°C)"),
+		absoluteHumidity:         newGauge("ruuvi_absolute_humidity_grams_per_cubic_meter", "Ruuvi: absolute humidity (g/m³)"),
+		equilibriumVaporPressure: newGauge("ruuvi_equilibrium_vapor_pressure_pascals", "Ruuvi: saturation vapor pressure at current temperature (Pa)"),
+		vaporPressureDeficit:     newGauge("ruuvi_vapor_pressure_deficit_pascals", "Ruuvi: vapor pressure deficit (Pa)"),
+		txPower:                  newGauge("ruuvi_tx_power", "Ruuvi: TX power (dBm)"),
+		// wraps around at 255, so it's not a Prometheus counter
+		movementCounter:           newGauge("ruuvi_movement_counter", "Ruuvi: movement counter"),
+		measurementSequenceNumber: newGauge("ruuvi_measurement_sequence_number", "Ruuvi: measurement sequence number"),
+		rssi:                      newGauge("ruuvi_rssi", "Ruuvi: received signal strength (dBm)"),
+		deliveryLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ruuvinator_delivery_latency_seconds",
+			Help:    "Time from observation (at client) to it being processed here",
+			Buckets: []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 120, 300, 900, 3600},
+		}),
+		staleTimeout:      opts.StaleTimeout,
+		movementThreshold: opts.MovementThreshold,
+		tagLabels:         opts.TagLabels,
+		now:               time.Now,
+		sensors:           map[sensorKey]*sensorState{},
+	}
+
+	if m.movementThreshold == 0 {
+		m.movementThreshold = DefaultMovementThreshold
+	}
+
+	registerer.MustRegister(m.lastSeen, m.up, m.movementsDetected, m.deliveryLatency)
+
+	if opts.UseObservationTimestamps {
+		registerer.MustRegister(&timestampingCollector{m})
+	} else {
+		for _, gauge := range m.measurementGauges() {
+			registerer.MustRegister(gauge)
+		}
+	}
+
+	return m
+}
+
+// exports the measurement gauges with the sensor's latest observation time as timestamp
+type timestampingCollector struct {
+	metrics *Metrics
+}
+
+func (t *timestampingCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, gauge := range t.metrics.measurementGauges() {
+		gauge.Describe(ch)
+	}
+}
+
+func (t *timestampingCollector) Collect(ch chan<- prometheus.Metric) {
+	// taken up front, because Observe() holds sensorsMu while it writes to the gauges. doing it
+	// per metric while a gauge is being collected would deadlock.
+	lastSeen := t.metrics.lastSeenBySensor()
+
+	for _, gauge := range t.metrics.measurementGauges() {
+		gaugeCh := make(chan prometheus.Metric)
+
+		go func(gauge *prometheus.GaugeVec) {
+			gauge.Collect(gaugeCh)
+			close(gaugeCh)
+		}(gauge)
+
+		for metric := range gaugeCh {
+			ch <- withTimestamp(metric, lastSeen)
+		}
+	}
+}
+
+func withTimestamp(metric prometheus.Metric, lastSeen map[sensorKey]time.Time) prometheus.Metric {
+	metricPb := &dto.Metric{}
+	if err := metric.Write(metricPb); err != nil {
+		return metric
+	}
+
+	key := sensorKey{}
+
+	for _, label := range metricPb.Label {
+		switch label.GetName() {
+		case "sensor":
+			key.addr = label.GetValue()
+		case "name":
+			key.name = label.GetValue()
+		}
+	}
+
+	observedAt, found := lastSeen[key]
+	if !found {
+		return metric
+	}
+
+	return prometheus.NewMetricWithTimestamp(observedAt, metric)
+}
@@ -0,0 +1,200 @@
+package ruuvimetrics
+
+import (
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStaleSensorIsMarkedDown(t *testing.T) {
+	metrics := New(prometheus.NewRegistry(), Options{StaleTimeout: 5 * time.Minute})
+
+	t0 := time.Date(2019, 3, 17, 14, 22, 17, 0, time.UTC)
+
+	metrics.Observe(observationAt("aa:bb:cc:dd:ee:ff", "Sauna", t0))
+	metrics.Observe(observationAt("ff:ee:dd:cc:bb:aa", "Fridge", t0.Add(4*time.Minute)))
+
+	sauna := prometheus.Labels{"sensor": "aa:bb:cc:dd:ee:ff", "name": "Sauna"}
+	fridge := prometheus.Labels{"sensor": "ff:ee:dd:cc:bb:aa", "name": "Fridge"}
+
+	assert.True(t, testutil.ToFloat64(metrics.up.With(sauna)) == 1)
+	assert.True(t, testutil.ToFloat64(metrics.lastSeen.With(sauna)) == float64(t0.Unix()))
+	assert.True(t, seriesCount(metrics.temperature) == 2)
+
+	metrics.ExpireStale(t0.Add(6 * time.Minute))
+
+	assert.True(t, testutil.ToFloat64(metrics.up.With(sauna)) == 0)
+	assert.True(t, testutil.ToFloat64(metrics.up.With(fridge)) == 1)
+	assert.True(t, testutil.ToFloat64(metrics.lastSeen.With(sauna)) == float64(t0.Unix()))
+	// Sauna's measurements dropped
+	assert.True(t, seriesCount(metrics.temperature) == 1)
+
+	// comes back alive
+	metrics.Observe(observationAt("aa:bb:cc:dd:ee:ff", "Sauna", t0.Add(7*time.Minute)))
+
+	assert.True(t, testutil.ToFloat64(metrics.up.With(sauna)) == 1)
+	assert.True(t, seriesCount(metrics.temperature) == 2)
+}
+
+func TestObservationTimestampsAndLatency(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	metrics := New(registry, Options{UseObservationTimestamps: true})
+
+	t0 := time.Date(2019, 3, 17, 14, 22, 17, 0, time.UTC)
+
+	metrics.now = func() time.Time { return t0.Add(3 * time.Second) }
+
+	metrics.Observe(observationAt("aa:bb:cc:dd:ee:ff", "Sauna", t0))
+
+	// delayed older observation doesn't overwrite newer one
+	older := observationAt("aa:bb:cc:dd:ee:ff", "Sauna", t0.Add(-time.Minute))
+	older.Observation.Measurements.Temperature = -40
+	metrics.Observe(older)
+
+	families, err := registry.Gather()
+	assert.True(t, err == nil)
+
+	temperatureFound := false
+
+	for _, family := range families {
+		switch family.GetName() {
+		case "ruuvi_temperature":
+			temperatureFound = true
+
+			assert.True(t, family.Metric[0].GetTimestampMs() == t0.UnixNano()/int64(time.Millisecond))
+			assert.True(t, family.Metric[0].GetGauge().GetValue() == 21.5)
+		case "ruuvinator_delivery_latency_seconds":
+			histogram := family.Metric[0].GetHistogram()
+
+			assert.True(t, histogram.GetSampleCount() == 2)
+			assert.True(t, histogram.GetSampleSum() == 3+63)
+		}
+	}
+
+	assert.True(t, temperatureFound)
+}
+
+func TestMovementDetection(t *testing.T) {
+	metrics := New(prometheus.NewRegistry(), Options{})
+
+	t0 := time.Date(2019, 3, 17, 14, 22, 17, 0, time.UTC)
+
+	sauna := prometheus.Labels{"sensor": "aa:bb:cc:dd:ee:ff", "name": "Sauna"}
+
+	observe := func(seconds int, x int16, y int16, z int16) {
+		observation := observationAt("aa:bb:cc:dd:ee:ff", "Sauna", t0.Add(time.Duration(seconds)*time.Second))
+		observation.Observation.Measurements.Acceleration = &ruuvinatortypes.AccelerationData{X: x, Y: y, Z: z}
+		metrics.Observe(observation)
+	}
+
+	movements := func() float64 {
+		return testutil.ToFloat64(metrics.movementsDetected.With(sauna))
+	}
+
+	observe(0, 0, 0, 1000) // lying flat
+	assert.True(t, movements() == 0)
+	assert.True(t, testutil.ToFloat64(metrics.accelerationZ.With(sauna)) == 1)
+	assert.True(t, testutil.ToFloat64(metrics.accelerationMagnitude.With(sauna)) == 1)
+	assert.True(t, testutil.ToFloat64(metrics.tiltPitch.With(sauna)) == 0)
+
+	observe(1, 20, 0, 1010) // sensor noise
+	assert.True(t, movements() == 0)
+
+	observe(2, 1000, 0, 0) // stood on its side
+	assert.True(t, movements() == 1)
+	assert.True(t, testutil.ToFloat64(metrics.tiltPitch.With(sauna)) == 90)
+}
+
+func TestTagLabels(t *testing.T) {
+	assert.EqualString(t, ValidateTagLabels([]string{"floor", "name"}).Error(), "tag label name: reserved")
+	assert.EqualString(t, ValidateTagLabels([]string{"floor-2"}).Error(), "tag label floor-2: not a valid Prometheus label name")
+
+	metrics := New(prometheus.NewRegistry(), Options{TagLabels: []string{"building", "floor"}})
+
+	t0 := time.Date(2019, 3, 17, 14, 22, 17, 0, time.UTC)
+
+	sauna := observationAt("aa:bb:cc:dd:ee:ff", "Sauna", t0)
+	sauna.SensorTags = map[string]string{"building": "HQ", "floor": "2", "owner": "Joonas"}
+
+	metrics.Observe(sauna)
+	metrics.Observe(observationAt("ff:ee:dd:cc:bb:aa", "Fridge", t0)) // no tags
+
+	assert.True(t, testutil.ToFloat64(metrics.temperature.With(prometheus.Labels{
+		"sensor":   "aa:bb:cc:dd:ee:ff",
+		"name":     "Sauna",
+		"building": "HQ",
+		"floor":    "2",
+	})) == 21.5)
+	assert.True(t, seriesCount(metrics.temperature) == 2)
+
+	// moved to another floor => old series is gone
+	sauna.SensorTags = map[string]string{"building": "HQ", "floor": "3"}
+	sauna.Observation.Time = t0.Add(time.Minute)
+	metrics.Observe(sauna)
+
+	assert.True(t, seriesCount(metrics.temperature) == 2)
+	assert.True(t, seriesCount(metrics.up) == 2)
+}
+
+func TestConcurrentObservationsKeepNewest(t *testing.T) {
+	metrics := New(prometheus.NewRegistry(), Options{})
+
+	t0 := time.Date(2019, 3, 17, 14, 22, 17, 0, time.UTC)
+
+	// like /ingest and queue consumer delivering the same sensor's observations
+	observeEvery := func(first int, wg *sync.WaitGroup) {
+		defer wg.Done()
+
+		for i := first; i < 2000; i += 2 {
+			observation := observationAt("aa:bb:cc:dd:ee:ff", "Sauna", t0.Add(time.Duration(i)*time.Second))
+			observation.Observation.Measurements.Temperature = float64(i)
+			metrics.Observe(observation)
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go observeEvery(0, wg)
+	go observeEvery(1, wg)
+	wg.Wait()
+
+	sauna := prometheus.Labels{"sensor": "aa:bb:cc:dd:ee:ff", "name": "Sauna"}
+
+	assert.True(t, testutil.ToFloat64(metrics.temperature.With(sauna)) == 1999)
+	assert.True(t, testutil.ToFloat64(metrics.lastSeen.With(sauna)) == float64(t0.Add(1999*time.Second).Unix()))
+}
+
+func observationAt(addr string, name string, ts time.Time) ruuvinatortypes.ResolvedSensorObservation {
+	return ruuvinatortypes.ResolvedSensorObservation{
+		SensorName: name,
+		Observation: ruuvinatortypes.SensorObservation{
+			SensorAddr: addr,
+			Time:       ts,
+			Measurements: ruuvinatortypes.SensorMeasurements{
+				Temperature: 21.5,
+			},
+		},
+	}
+}
+
+// like testutil.CollectAndCount(), which our client_golang version doesn't have yet
+func seriesCount(collector prometheus.Collector) int {
+	ch := make(chan prometheus.Metric)
+
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+
+	count := 0
+	for range ch {
+		count++
+	}
+
+	return count
+}
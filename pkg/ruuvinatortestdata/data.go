@@ -31,3 +31,22 @@ device: hci0 snap_len: 1500 filter: 0xffffffff
 < 01 0C 20 02 00 00
 > 04 0E 04 01 0C 20 00
 `
+
+// one format 5 (RAWv2) frame, payload is the "valid data" test vector from Ruuvi's spec
+const DemoStreamFormat5 = `HCI sniffer - Bluetooth packet analyzer ver 5.50
+device: hci0 snap_len: 1500 filter: 0xffffffff
+> 04 3E 2B 02 01 03 01 4F 88 4C 33 B8 CB 1F 02 01 06 1B FF 99
+  04 05 12 FC 53 94 C3 7C 00 04 FF FC 04 0C AC 36 42 00 CD CB
+  B8 33 4C 88 4F C2
+> 04 0E 04 01 0C 20 00
+`
+
+// same format as "$ hcidump --raw -t" gives
+const DemoStreamWithTimestamps = `HCI sniffer - Bluetooth packet analyzer ver 5.50
+device: hci0 snap_len: 1500 filter: 0xffffffff
+1552832537.123456 > 04 3E 21 02 01 03 01 15 90 09 36 72 FB 15 02 01 06 11 FF 99
+  04 03 47 13 44 BE EB 00 31 FF D7 04 0A 0C 55 D4
+1552832538.623456 > 04 3E 25 02 01 03 01 65 EF 7E 12 FA E5 19 02 01 04 15 FF 99
+  04 03 AE 01 0D C2 5A 02 1E 01 A5 FD 2A 0B 1D 00 00 00 00 A7
+1552832538.700000 < 01 0C 20 02 00 00
+`
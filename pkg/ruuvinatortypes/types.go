@@ -1,21 +1,60 @@
 package ruuvinatortypes
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"time"
 )
 
 type SensorObservation struct {
-	SensorAddr   string             `json:"sensor_addr"`
-	Time         time.Time          `json:"time"`
-	Measurements SensorMeasurements `json:"measurements"`
+	SensorAddr    string                `json:"sensor_addr"`
+	Time          time.Time             `json:"time"`
+	Measurements  SensorMeasurements    `json:"measurements"`
+	Advertisement AdvertisementMetadata `json:"advertisement"`
+}
+
+// from the HCI LE Advertising Report that carried the measurements
+type AdvertisementMetadata struct {
+	Rssi        *int  `json:"rssi,omitempty"` // dBm. nil = not available
+	AddressType uint8 `json:"address_type"`   // 0 = public, 1 = random
+	EventType   uint8 `json:"event_type"`     // 0 = ADV_IND, 1 = ADV_DIRECT_IND, 2 = ADV_SCAN_IND, 3 = ADV_NONCONN_IND, 4 = SCAN_RSP
 }
 
 type SensorMeasurements struct {
-	Temperature  float64          `json:"temperature"`
-	Humidity     float64          `json:"humidity"`
-	Pressure     uint32           `json:"pressure"`
-	Battery      float64          `json:"battery"`
-	Acceleration AccelerationData `json:"acceleration"`
+	DataFormat  uint8   `json:"data_format"`
+	Temperature float64 `json:"temperature"`
+	// format 5 sensors can signal these as not available
+	Humidity     *float64          `json:"humidity,omitempty"`
+	Pressure     *uint32           `json:"pressure,omitempty"` // Pa
+	Battery      *float64          `json:"battery,omitempty"`  // V
+	Acceleration *AccelerationData `json:"acceleration,omitempty"`
+	// below are only available from data format 5 onwards (and even then, the sensor can
+	// signal any of them as not available)
+	TxPower                   *int    `json:"tx_power,omitempty"` // dBm
+	MovementCounter           *uint8  `json:"movement_counter,omitempty"`
+	MeasurementSequenceNumber *uint16 `json:"measurement_sequence_number,omitempty"`
+	Mac                       *string `json:"mac,omitempty"`
+	// computed from the above. only present if enabled with "derived_measurements"
+	Derived *DerivedMeasurements `json:"derived,omitempty"`
+	// values before calibration. only present if enabled with calibration's "keep_raw"
+	Raw *RawMeasurements `json:"raw,omitempty"`
+}
+
+// the ones that calibration can change
+type RawMeasurements struct {
+	Temperature float64  `json:"temperature"`
+	Humidity    *float64 `json:"humidity,omitempty"`
+	Pressure    *uint32  `json:"pressure,omitempty"`
+	Battery     *float64 `json:"battery,omitempty"`
+}
+
+// from temperature and humidity
+type DerivedMeasurements struct {
+	DewPoint                 float64 `json:"dew_point"`                  // °C
+	AbsoluteHumidity         float64 `json:"absolute_humidity"`          // g/m³
+	EquilibriumVaporPressure float64 `json:"equilibrium_vapor_pressure"` // Pa
+	VaporPressureDeficit     float64 `json:"vapor_pressure_deficit"`     // Pa
 }
 
 type AccelerationData struct {
@@ -26,19 +65,213 @@ type AccelerationData struct {
 
 type Output interface {
 	GetObservationsChan() chan<- ResolvedSensorObservation
+	// stops accepting observations and returns once the ones already given have been
+	// delivered (or given up on). don't send to the channel after calling this.
+	Close()
+}
+
+// output that can deliver a batch synchronously and tell whether it succeeded. these can be
+// fronted with a durable on-disk queue (observations are forgotten only after delivery)
+type BatchOutput interface {
+	Output
+	WriteBatch(ctx context.Context, batch []ResolvedSensorObservation) error
+}
+
+// WriteBatch() returns this when the destination won't ever accept the batch (retrying
+// wouldn't help), so the queue can give up on it instead of blocking the ones after it
+type PermanentError struct {
+	Err error
+}
+
+func (p *PermanentError) Error() string {
+	return p.Err.Error()
+}
+
+func NewPermanentError(err error) error {
+	return &PermanentError{err}
+}
+
+func IsPermanentError(err error) bool {
+	_, permanent := err.(*PermanentError)
+	return permanent
+}
+
+// btAddr => sensor
+type SensorWhitelist map[string]WhitelistedSensor
+
+type WhitelistedSensor struct {
+	Name        string             `json:"name"`
+	Tags        map[string]string  `json:"tags,omitempty"` // {"building": "HQ", "floor": "2"}
+	Calibration *SensorCalibration `json:"calibration,omitempty"`
+}
+
+// accepts also just the friendly name, i.e. `"aa:bb:cc:dd:ee:ff": "Bedroom"`
+func (w *WhitelistedSensor) UnmarshalJSON(data []byte) error {
+	name := ""
+	if err := json.Unmarshal(data, &name); err == nil {
+		*w = WhitelistedSensor{Name: name}
+		return nil
+	}
+
+	// without our UnmarshalJSON, so we don't recurse
+	type whitelistedSensorFields WhitelistedSensor
+
+	// unknown fields not disallowed by the outer decoder reaching in here
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode((*whitelistedSensorFields)(w))
+}
+
+// enrolled sensors are written to the registry file (same format as "sensor_whitelist"),
+// where you can rename them, add tags etc. without restarting
+type AutoEnrollmentConfig struct {
+	RegistryFile  string `json:"registry_file"`
+	MinRssi       *int   `json:"min_rssi"`       // optional. only enroll sensors this close (dBm, like -70)
+	AddressPrefix string `json:"address_prefix"` // optional. only enroll matching sensors (like "fb:72:")
+}
+
+// corrects sensor's drift against a reference instrument. each one is optional
+type SensorCalibration struct {
+	Temperature *LinearCalibration `json:"temperature"`
+	Humidity    *LinearCalibration `json:"humidity"`
+	Pressure    *LinearCalibration `json:"pressure"` // Pa
+	Battery     *LinearCalibration `json:"battery"`  // V
+	KeepRaw     bool               `json:"keep_raw"` // keep uncalibrated values in observation
 }
 
-// btAddr => friendlyName
-type SensorWhitelist map[string]string
+// calibrated = raw * gain + offset
+type LinearCalibration struct {
+	Offset float64  `json:"offset"`
+	Gain   *float64 `json:"gain"` // default 1
+}
 
 type Config struct {
-	Output          string           `json:"output"`
-	SensorWhitelist SensorWhitelist  `json:"sensor_whitelist"`
-	SqsOutputConfig *SqsOutputConfig `json:"sqsoutput_config"` // used if output=sqsoutput
+	BluetoothReceiver string          `json:"bluetooth_receiver"` // "hcidump" (default) | "socket"
+	HciDevice         int             `json:"hci_device"`         // used if bluetooth_receiver=socket. 0 = hci0
+	Outputs           []OutputConfig  `json:"outputs"`
+	SensorWhitelist   SensorWhitelist `json:"sensor_whitelist"`
+	// optional: unknown sensors are enrolled (instead of dropped)
+	AutoEnrollment *AutoEnrollmentConfig `json:"auto_enrollment"`
+	CaptureConfig  *CaptureConfig        `json:"capture_config"` // optional: also write raw frames to files
+	// add dew point, absolute humidity etc. to observations (shows up in JSON outputs)
+	DerivedMeasurements bool `json:"derived_measurements"`
+	// single output the old way. still supported, but prefer "outputs"
+	Output                 string                  `json:"output"`
+	SqsOutputConfig        *SqsOutputConfig        `json:"sqsoutput_config"`        // used if output=sqsoutput
+	PrometheusOutputConfig *PrometheusOutputConfig `json:"prometheusoutput_config"` // used if output=prometheus
+}
+
+// "outputs" with the old-style single "output" appended (if defined)
+func (c *Config) AllOutputs() []OutputConfig {
+	if c.Output == "" {
+		return c.Outputs
+	}
+
+	return append(append([]OutputConfig{}, c.Outputs...), OutputConfig{
+		Type:                   c.Output,
+		SqsOutputConfig:        c.SqsOutputConfig,
+		PrometheusOutputConfig: c.PrometheusOutputConfig,
+	})
+}
+
+type OutputConfig struct {
+	Type                   string                  `json:"type"`                    // "console" | "sqsoutput" | "queue" | "http" | "prometheus" | "mqtt" | "influxdb"
+	SqsOutputConfig        *SqsOutputConfig        `json:"sqsoutput_config"`        // used if type=sqsoutput
+	QueueOutputConfig      *QueueConfig            `json:"queueoutput_config"`      // used if type=queue
+	HttpOutputConfig       *HttpOutputConfig       `json:"httpoutput_config"`       // used if type=http
+	PrometheusOutputConfig *PrometheusOutputConfig `json:"prometheusoutput_config"` // used if type=prometheus
+	MqttOutputConfig       *MqttOutputConfig       `json:"mqttoutput_config"`       // used if type=mqtt
+	InfluxOutputConfig     *InfluxOutputConfig     `json:"influxoutput_config"`     // used if type=influxdb
+	DurableQueue           *DurableQueueConfig     `json:"durable_queue"`           // optional: keep observations on disk until delivered
+}
+
+// each output needs its own directory
+type DurableQueueConfig struct {
+	Directory string `json:"directory"`
+	MaxBytes  int64  `json:"max_bytes"` // oldest observations are dropped after this. 0 = no limit
+}
+
+// pushes to metricsserver's ingest endpoint
+type HttpOutputConfig struct {
+	Url   string `json:"url"`   // "https://metrics.example.com/ingest"
+	Token string `json:"token"` // INGEST_TOKEN of metricsserver
+}
+
+type PrometheusOutputConfig struct {
+	ListenAddr string `json:"listen_addr"` // ":9100" serves "http://<any interface>:9100/metrics"
+	// sensor silent for longer than this is marked down and its measurements dropped.
+	// 0 = default (5 minutes)
+	StaleTimeoutSeconds int `json:"stale_timeout_seconds"`
+	// export measurements with time of observation instead of scrape time
+	UseObservationTimestamps bool `json:"use_observation_timestamps"`
+	// change in acceleration (g) between observations that counts as movement. 0 = default (0.1)
+	MovementThreshold float64 `json:"movement_threshold"`
+	// sensor tags to add as labels (["building", "floor"]). sensors without the tag get ""
+	TagLabels []string `json:"tag_labels"`
+}
+
+type MqttOutputConfig struct {
+	BrokerUrl                    string `json:"broker_url"` // "tcp://host:1883" or "ssl://host:8883"
+	ClientId                     string `json:"client_id"`  // default "ruuvinator"
+	Username                     string `json:"username"`
+	Password                     string `json:"password"`
+	TopicPrefix                  string `json:"topic_prefix"` // default "ruuvinator"
+	Qos                          byte   `json:"qos"`
+	Retain                       bool   `json:"retain"`
+	TlsCaFile                    string `json:"tls_ca_file"`   // if broker cert is not signed by a system-trusted CA
+	TlsCertFile                  string `json:"tls_cert_file"` // client certificate authentication
+	TlsKeyFile                   string `json:"tls_key_file"`
+	TlsInsecureSkipVerify        bool   `json:"tls_insecure_skip_verify"`
+	HomeAssistantDiscovery       bool   `json:"homeassistant_discovery"`
+	HomeAssistantDiscoveryPrefix string `json:"homeassistant_discovery_prefix"` // default "homeassistant"
+}
+
+type InfluxOutputConfig struct {
+	Url             string `json:"url"` // "http://localhost:8086"
+	Database        string `json:"database"`
+	RetentionPolicy string `json:"retention_policy"` // optional
+	Username        string `json:"username"`         // optional
+	Password        string `json:"password"`
+	Token           string `json:"token"`           // optional. InfluxDB 2.x (its v1 compatible write API)
+	SpoolDirectory  string `json:"spool_directory"` // optional. where to keep batches while server is unreachable
+	MaxSpoolBytes   int64  `json:"max_spool_bytes"` // oldest spooled batches are dropped after this. 0 = no limit
+}
+
+// capture files can be replayed with "$ ruuvinator replay"
+type CaptureConfig struct {
+	Directory     string `json:"directory"`
+	MaxSizeBytes  int64  `json:"max_size_bytes"`  // start new file after this size. 0 = no limit
+	MaxAgeSeconds int    `json:"max_age_seconds"` // start new file after this age. 0 = no limit
+	MaxFiles      int    `json:"max_files"`       // oldest files are deleted after this. 0 = no limit
+}
+
+// message queue between client and metricsserver
+type QueueConfig struct {
+	Transport string            `json:"transport"` // "sqs" (default) | "redis"
+	Sqs       *SqsOutputConfig  `json:"sqs"`       // used if transport=sqs
+	Redis     *RedisQueueConfig `json:"redis"`     // used if transport=redis
+}
+
+// uses a Redis stream (Redis >= 5)
+type RedisQueueConfig struct {
+	Addr     string `json:"addr"` // "localhost:6379"
+	Password string `json:"password"`
+	Db       int    `json:"db"`
+	Stream   string `json:"stream"`   // default "ruuvinator"
+	Group    string `json:"group"`    // consumer group of metricsserver. default "metricsserver"
+	Consumer string `json:"consumer"` // consumer name of metricsserver within group. default hostname
+	MaxLen   int64  `json:"max_len"`  // stream is trimmed to about this many messages. 0 = no limit
+	// metricsserver moves messages it can't process here. default "<stream>:dead"
+	DeadLetterStream string `json:"dead_letter_stream"`
 }
 
 type SqsOutputConfig struct {
-	QueueUrl           string `json:"queue_url"`
+	QueueUrl string `json:"queue_url"`
+	Region   string `json:"region"`   // optional. default from AWS_REGION / shared profile / queue_url
+	Endpoint string `json:"endpoint"` // optional. for SQS-compatible stand-ins like ElasticMQ or LocalStack
+	// optional. without these the standard AWS credential chain (env, shared profile,
+	// instance role) is used
 	AwsAccessKeyId     string `json:"aws_access_key_id"`
 	AwsAccessKeySecret string `json:"aws_access_key_secret"`
 }
@@ -47,6 +280,7 @@ type SqsOutputConfig struct {
 // and thus its friendly name is now also known
 type ResolvedSensorObservation struct {
 	SensorName  string            `json:"sensor_name"`
+	SensorTags  map[string]string `json:"sensor_tags,omitempty"`
 	Observation SensorObservation `json:"observation"`
 }
 
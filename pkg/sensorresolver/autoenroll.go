@@ -0,0 +1,204 @@
+package sensorresolver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/function61/gokit/logger"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logger.New("sensorresolver")
+
+const (
+	// how often to check if someone edited the registry file
+	registryReloadInterval = 5 * time.Second
+)
+
+// resolves whitelisted sensors like the whitelist resolver, but instead of dropping unknown
+// sensors adds them (with generated names) to a registry file. the registry is in the same
+// format as "sensor_whitelist", and edits to it (renames, tags, calibration) are picked up
+// without a restart.
+type autoEnrollResolver struct {
+	config         ruuvinatortypes.AutoEnrollmentConfig
+	whitelist      ruuvinatortypes.SensorWhitelist // from config. these win over the registry
+	registryMu     sync.Mutex
+	registry       ruuvinatortypes.SensorWhitelist
+	unsaved        ruuvinatortypes.SensorWhitelist // enrolled, but not yet written to registry
+	registryMtime  time.Time
+	registryLoaded time.Time
+	now            func() time.Time // for tests
+}
+
+func NewAutoEnroll(
+	config ruuvinatortypes.AutoEnrollmentConfig,
+	whitelist ruuvinatortypes.SensorWhitelist,
+) (ruuvinatortypes.SensorResolver, error) {
+	if config.RegistryFile == "" {
+		return nil, fmt.Errorf("auto_enrollment: registry_file not set")
+	}
+
+	a := &autoEnrollResolver{
+		config:    config,
+		whitelist: whitelist,
+		registry:  ruuvinatortypes.SensorWhitelist{},
+		unsaved:   ruuvinatortypes.SensorWhitelist{},
+		now:       time.Now,
+	}
+
+	if err := a.reloadRegistryIfChanged(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *autoEnrollResolver) Resolve(observation ruuvinatortypes.SensorObservation) (*ruuvinatortypes.ResolvedSensorObservation, bool) {
+	if sensor, whitelisted := a.whitelist[observation.SensorAddr]; whitelisted {
+		return resolve(sensor, observation), true
+	}
+
+	a.registryMu.Lock()
+	defer a.registryMu.Unlock()
+
+	if a.now().Sub(a.registryLoaded) >= registryReloadInterval {
+		reloadOrSave := a.reloadRegistryIfChanged
+		if len(a.unsaved) > 0 {
+			reloadOrSave = a.saveRegistry // also reloads
+		}
+
+		if err := reloadOrSave(); err != nil {
+			// keep using what we have. maybe the editor is not done yet
+			log.Error(fmt.Sprintf("registry: %s", err.Error()))
+		}
+	}
+
+	sensor, enrolled := a.registry[observation.SensorAddr]
+	if !enrolled {
+		if !a.shouldEnroll(observation) {
+			return nil, false
+		}
+
+		sensor = ruuvinatortypes.WhitelistedSensor{
+			Name: generateName(observation.SensorAddr),
+		}
+
+		a.registry[observation.SensorAddr] = sensor
+		a.unsaved[observation.SensorAddr] = sensor
+
+		log.Info(fmt.Sprintf("enrolled %s as %s", observation.SensorAddr, sensor.Name))
+
+		if err := a.saveRegistry(); err != nil {
+			// still resolve, so we don't lose observations. enrollment is kept in memory and
+			// saving is retried on next registry check
+			log.Error(fmt.Sprintf("registry: %s (enrollment of %s not saved yet)", err.Error(), observation.SensorAddr))
+		}
+	}
+
+	return resolve(sensor, observation), true
+}
+
+func (a *autoEnrollResolver) shouldEnroll(observation ruuvinatortypes.SensorObservation) bool {
+	if a.config.MinRssi != nil {
+		// unknown distance can't pass
+		rssi := observation.Advertisement.Rssi
+		if rssi == nil || *rssi < *a.config.MinRssi {
+			return false
+		}
+	}
+
+	return strings.HasPrefix(
+		strings.ToLower(observation.SensorAddr),
+		strings.ToLower(a.config.AddressPrefix))
+}
+
+func (a *autoEnrollResolver) reloadRegistryIfChanged() error {
+	a.registryLoaded = a.now()
+
+	stat, err := os.Stat(a.config.RegistryFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // nothing enrolled yet
+		}
+
+		return err
+	}
+
+	if stat.ModTime().Equal(a.registryMtime) {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(a.config.RegistryFile)
+	if err != nil {
+		return err
+	}
+
+	registry := ruuvinatortypes.SensorWhitelist{}
+	if err := json.Unmarshal(content, &registry); err != nil {
+		return err
+	}
+
+	// enrollments not yet in the file. user's entry for the same sensor wins
+	for addr, sensor := range a.unsaved {
+		if _, inFile := registry[addr]; !inFile {
+			registry[addr] = sensor
+		}
+	}
+
+	a.registry = registry
+	a.registryMtime = stat.ModTime()
+
+	return nil
+}
+
+// atomically, so a crash doesn't leave half a registry. edits made to the file since we last
+// loaded it are merged in first, and if the file doesn't parse we don't overwrite it.
+func (a *autoEnrollResolver) saveRegistry() error {
+	if err := a.reloadRegistryIfChanged(); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(a.registry, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(a.config.RegistryFile), 0755); err != nil {
+		return err
+	}
+
+	tempFile := a.config.RegistryFile + ".tmp"
+
+	if err := ioutil.WriteFile(tempFile, content, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempFile, a.config.RegistryFile); err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(a.config.RegistryFile)
+	if err != nil {
+		return err
+	}
+
+	a.registryMtime = stat.ModTime() // our own write is not an edit to reload
+	a.unsaved = ruuvinatortypes.SensorWhitelist{}
+
+	return nil
+}
+
+// "fb:72:36:09:90:15" => "Ruuvi 9015" (like the official Ruuvi app does)
+func generateName(addr string) string {
+	hexOnly := strings.ToUpper(strings.Replace(addr, ":", "", -1))
+	if len(hexOnly) > 4 {
+		hexOnly = hexOnly[len(hexOnly)-4:]
+	}
+
+	return "Ruuvi " + hexOnly
+}
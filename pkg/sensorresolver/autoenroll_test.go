@@ -0,0 +1,164 @@
+package sensorresolver
+
+import (
+	"github.com/function61/gokit/assert"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAutoEnroll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensorresolver")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	registryFile := filepath.Join(dir, "registry.json")
+
+	minRssi := -80
+
+	resolver, err := NewAutoEnroll(ruuvinatortypes.AutoEnrollmentConfig{
+		RegistryFile:  registryFile,
+		MinRssi:       &minRssi,
+		AddressPrefix: "FB:72:",
+	}, ruuvinatortypes.SensorWhitelist{
+		"aa:bb:cc:dd:ee:ff": {Name: "Bedroom"},
+	})
+	assert.True(t, err == nil)
+
+	now := time.Now()
+	resolver.(*autoEnrollResolver).now = func() time.Time { return now }
+
+	resolvedName := func(addr string, rssi int) string {
+		resolved, ok := resolver.Resolve(ruuvinatortypes.SensorObservation{
+			SensorAddr: addr,
+			Advertisement: ruuvinatortypes.AdvertisementMetadata{
+				Rssi: &rssi,
+			},
+		})
+		if !ok {
+			return "(not resolved)"
+		}
+
+		return resolved.SensorName
+	}
+
+	assert.EqualString(t, resolvedName("aa:bb:cc:dd:ee:ff", -90), "Bedroom")
+	assert.EqualString(t, resolvedName("fb:72:36:09:90:15", -90), "(not resolved)") // too far
+
+	// RSSI not known (e.g. from JSON without "advertisement")
+	_, ok := resolver.Resolve(ruuvinatortypes.SensorObservation{SensorAddr: "fb:72:36:09:90:15"})
+	assert.True(t, !ok)
+
+	assert.EqualString(t, resolvedName("fb:72:36:09:90:15", -60), "Ruuvi 9015")
+	assert.EqualString(t, resolvedName("fb:72:36:09:90:15", -90), "Ruuvi 9015")     // once enrolled, distance doesn't matter
+	assert.EqualString(t, resolvedName("c1:d2:e3:f4:a5:b6", -60), "(not resolved)") // prefix doesn't match
+
+	// user renames the sensor
+	assert.True(t, ioutil.WriteFile(registryFile, []byte(`{
+	"fb:72:36:09:90:15": {
+		"name": "Greenhouse",
+		"tags": {"floor": "1"}
+	}
+}`), 0644) == nil)
+	// mtime resolution of some filesystems is coarse
+	assert.True(t, os.Chtimes(registryFile, now, now.Add(time.Hour)) == nil)
+
+	assert.EqualString(t, resolvedName("fb:72:36:09:90:15", -60), "Ruuvi 9015") // not checked yet
+
+	now = now.Add(registryReloadInterval)
+
+	assert.EqualString(t, resolvedName("fb:72:36:09:90:15", -60), "Greenhouse")
+
+	// new enrollment keeps the edit
+	assert.EqualString(t, resolvedName("fb:72:aa:bb:cc:dd", -60), "Ruuvi CCDD")
+
+	registry, err := ioutil.ReadFile(registryFile)
+	assert.True(t, err == nil)
+	assert.EqualString(t, string(registry), `{
+	"fb:72:36:09:90:15": {
+		"name": "Greenhouse",
+		"tags": {
+			"floor": "1"
+		}
+	},
+	"fb:72:aa:bb:cc:dd": {
+		"name": "Ruuvi CCDD"
+	}
+}`)
+}
+
+func TestAutoEnrollKeepsEditsMadeBetweenChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensorresolver")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	registryFile := filepath.Join(dir, "registry.json")
+
+	resolver, err := NewAutoEnroll(ruuvinatortypes.AutoEnrollmentConfig{
+		RegistryFile: registryFile,
+	}, ruuvinatortypes.SensorWhitelist{})
+	assert.True(t, err == nil)
+
+	now := time.Now()
+	resolver.(*autoEnrollResolver).now = func() time.Time { return now }
+
+	resolvedName := func(addr string) string {
+		resolved, ok := resolver.Resolve(ruuvinatortypes.SensorObservation{SensorAddr: addr})
+		if !ok {
+			return "(not resolved)"
+		}
+
+		return resolved.SensorName
+	}
+
+	editRegistry := func(content string) {
+		assert.True(t, ioutil.WriteFile(registryFile, []byte(content), 0644) == nil)
+		// mtime resolution of some filesystems is coarse
+		now = now.Add(time.Second)
+		assert.True(t, os.Chtimes(registryFile, now, now) == nil)
+	}
+
+	readRegistry := func() string {
+		content, err := ioutil.ReadFile(registryFile)
+		assert.True(t, err == nil)
+		return string(content)
+	}
+
+	assert.EqualString(t, resolvedName("fb:72:36:09:90:15"), "Ruuvi 9015")
+
+	// enrollment comes before the next check for edits
+	editRegistry(`{"fb:72:36:09:90:15": "Greenhouse"}`)
+
+	assert.EqualString(t, resolvedName("fb:72:aa:bb:cc:dd"), "Ruuvi CCDD")
+	assert.EqualString(t, readRegistry(), `{
+	"fb:72:36:09:90:15": {
+		"name": "Greenhouse"
+	},
+	"fb:72:aa:bb:cc:dd": {
+		"name": "Ruuvi CCDD"
+	}
+}`)
+
+	// editor not done yet. broken file must not be overwritten
+	editRegistry(`{"fb:72:36:09:90:15": "Green`)
+
+	assert.EqualString(t, resolvedName("c1:d2:e3:f4:a5:b6"), "Ruuvi A5B6")
+	assert.EqualString(t, readRegistry(), `{"fb:72:36:09:90:15": "Green`)
+
+	editRegistry(`{"fb:72:36:09:90:15": "Greenhouse 2"}`)
+	now = now.Add(registryReloadInterval)
+
+	// saved on next check, along with the edit
+	assert.EqualString(t, resolvedName("fb:72:36:09:90:15"), "Greenhouse 2")
+	assert.EqualString(t, readRegistry(), `{
+	"c1:d2:e3:f4:a5:b6": {
+		"name": "Ruuvi A5B6"
+	},
+	"fb:72:36:09:90:15": {
+		"name": "Greenhouse 2"
+	}
+}`)
+}
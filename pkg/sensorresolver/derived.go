@@ -0,0 +1,26 @@
+package sensorresolver
+
+import (
+	"github.com/function61/ruuvinator/pkg/ruuviderived"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+)
+
+type derivedMeasurementsResolver struct {
+	inner ruuvinatortypes.SensorResolver
+}
+
+// adds dew point etc. to resolved observations (computed from calibrated values)
+func WithDerivedMeasurements(inner ruuvinatortypes.SensorResolver) ruuvinatortypes.SensorResolver {
+	return &derivedMeasurementsResolver{inner}
+}
+
+func (d *derivedMeasurementsResolver) Resolve(observation ruuvinatortypes.SensorObservation) (*ruuvinatortypes.ResolvedSensorObservation, bool) {
+	resolved, ok := d.inner.Resolve(observation)
+	if !ok {
+		return nil, false
+	}
+
+	resolved.Observation.Measurements.Derived = ruuviderived.Environment(resolved.Observation.Measurements)
+
+	return resolved, true
+}
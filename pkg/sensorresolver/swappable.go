@@ -0,0 +1,33 @@
+package sensorresolver
+
+import (
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+	"sync"
+)
+
+// for config reloads: the pipeline keeps using this, while the actual resolver is swapped
+type Swappable struct {
+	currentMu sync.Mutex
+	current   ruuvinatortypes.SensorResolver
+}
+
+func NewSwappable(initial ruuvinatortypes.SensorResolver) *Swappable {
+	return &Swappable{
+		current: initial,
+	}
+}
+
+func (s *Swappable) Resolve(observation ruuvinatortypes.SensorObservation) (*ruuvinatortypes.ResolvedSensorObservation, bool) {
+	s.currentMu.Lock()
+	current := s.current
+	s.currentMu.Unlock()
+
+	return current.Resolve(observation)
+}
+
+func (s *Swappable) Swap(resolver ruuvinatortypes.SensorResolver) {
+	s.currentMu.Lock()
+	defer s.currentMu.Unlock()
+
+	s.current = resolver
+}
@@ -0,0 +1,40 @@
+package sensorresolver
+
+import (
+	"github.com/function61/ruuvinator/pkg/ruuvicalibration"
+	"github.com/function61/ruuvinator/pkg/ruuvinatortypes"
+)
+
+type whitelistResolver struct {
+	whitelist ruuvinatortypes.SensorWhitelist
+}
+
+func (w *whitelistResolver) Resolve(observation ruuvinatortypes.SensorObservation) (*ruuvinatortypes.ResolvedSensorObservation, bool) {
+	sensor, whitelisted := w.whitelist[observation.SensorAddr]
+	if !whitelisted {
+		return nil, false
+	}
+
+	return resolve(sensor, observation), true
+}
+
+func NewWhitelist(whitelist ruuvinatortypes.SensorWhitelist) ruuvinatortypes.SensorResolver {
+	return &whitelistResolver{
+		whitelist: whitelist,
+	}
+}
+
+func resolve(
+	sensor ruuvinatortypes.WhitelistedSensor,
+	observation ruuvinatortypes.SensorObservation,
+) *ruuvinatortypes.ResolvedSensorObservation {
+	if sensor.Calibration != nil {
+		observation.Measurements = ruuvicalibration.Apply(*sensor.Calibration, observation.Measurements)
+	}
+
+	return &ruuvinatortypes.ResolvedSensorObservation{
+		SensorName:  sensor.Name,
+		SensorTags:  sensor.Tags,
+		Observation: observation,
+	}
+}
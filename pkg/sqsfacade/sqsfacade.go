@@ -9,6 +9,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/function61/gokit/retry"
+	"regexp"
 	"time"
 )
 
@@ -19,28 +20,81 @@ const (
 // AWS SQS requires too much boilerplate that you can get wrong, for simple things.
 // therefore I had to build a facade to hide this misery
 
-func New(queueUrl string, accessKeyId string, accessKeySecret string) *SQS {
-	sess := session.Must(session.NewSession())
+type Config struct {
+	QueueUrl string
+	// "" = from AWS_REGION / shared profile, or from queue URL, or us-east-1 as last resort
+	Region string
+	// for SQS-compatible stand-ins (ElasticMQ, LocalStack). "" = AWS
+	Endpoint string
+	// optional. without these the standard credential chain (env, shared profile,
+	// instance role) is used
+	AccessKeyId     string
+	AccessKeySecret string
+}
+
+func New(conf Config) (*SQS, error) {
+	awsConfig := aws.Config{}
+
+	if conf.Region != "" {
+		awsConfig.Region = aws.String(conf.Region)
+	}
+
+	if conf.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(conf.Endpoint)
+	}
+
+	if conf.AccessKeyId != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(
+			conf.AccessKeyId,
+			conf.AccessKeySecret,
+			"")
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		SharedConfigState: session.SharedConfigEnable, // also region from ~/.aws/config
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig := &aws.Config{}
+
+	if aws.StringValue(sess.Config.Region) == "" {
+		region := regionFromQueueUrl(conf.QueueUrl)
+		if region == "" {
+			region = endpoints.UsEast1RegionID // the old hardcoded default
+		}
+
+		clientConfig.Region = aws.String(region)
+	}
 
 	return &SQS{
-		queueUrl: queueUrl,
-		client: sqs.New(sess, &aws.Config{
-			Region: aws.String(endpoints.UsEast1RegionID),
-			Credentials: credentials.NewStaticCredentials(
-				accessKeyId,
-				accessKeySecret,
-				""),
-		}),
+		queueUrl: conf.QueueUrl,
+		client:   sqs.New(sess, clientConfig),
+	}, nil
+}
+
+// "https://sqs.eu-west-1.amazonaws.com/123456789/Ruuvinator" => "eu-west-1".
+// "" if URL is not in that format (custom endpoints)
+func regionFromQueueUrl(queueUrl string) string {
+	match := regionFromQueueUrlRe.FindStringSubmatch(queueUrl)
+	if match == nil {
+		return ""
 	}
+
+	return match[1]
 }
 
+var regionFromQueueUrlRe = regexp.MustCompile(`^https://sqs\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?/`)
+
 type SQS struct {
 	queueUrl string
 	client   *sqs.SQS
 }
 
-func (s *SQS) Receive() (*sqs.ReceiveMessageOutput, error) {
-	output, err := s.client.ReceiveMessage(&sqs.ReceiveMessageInput{
+func (s *SQS) Receive(ctx context.Context) (*sqs.ReceiveMessageOutput, error) {
+	output, err := s.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
 		MaxNumberOfMessages: aws.Int64(10),
 		QueueUrl:            &s.queueUrl,
 		WaitTimeSeconds:     aws.Int64(10),
@@ -107,6 +161,12 @@ func (s *SQS) Send(
 		failed)
 }
 
+// like Send(), but without retries
+func (s *SQS) SendOnce(ctx context.Context, batch []*sqs.SendMessageBatchRequestEntry) error {
+	_, err := s.send(ctx, batch)
+	return err
+}
+
 func (s *SQS) send(
 	ctx context.Context,
 	batch []*sqs.SendMessageBatchRequestEntry,
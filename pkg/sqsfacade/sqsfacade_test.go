@@ -0,0 +1,12 @@
+package sqsfacade
+
+import (
+	"github.com/function61/gokit/assert"
+	"testing"
+)
+
+func TestRegionFromQueueUrl(t *testing.T) {
+	assert.EqualString(t, regionFromQueueUrl("https://sqs.eu-west-1.amazonaws.com/123456789/Ruuvinator"), "eu-west-1")
+	assert.EqualString(t, regionFromQueueUrl("https://sqs.cn-north-1.amazonaws.com.cn/123456789/Ruuvinator"), "cn-north-1")
+	assert.EqualString(t, regionFromQueueUrl("http://localhost:9324/queue/Ruuvinator"), "")
+}